@@ -1,10 +1,14 @@
 import { createApp } from 'vue'
 import { createPinia } from 'pinia'
 import App from './App.vue'
+import { useI18n } from './services/i18n'
 import './style.css'
 
 const app = createApp(App)
 const pinia = createPinia()
 
 app.use(pinia)
-app.mount('#app')
+
+// The catalog is loaded first so no untranslated text shows up.
+const { initI18n } = useI18n()
+initI18n().finally(() => app.mount('#app'))
@@ -0,0 +1,67 @@
+import { ref } from 'vue';
+import { useI18n } from './i18n';
+
+const authRequired = ref(false);
+const authenticated = ref(false);
+const checked = ref(false);
+const user = ref(null);
+
+// checkSession asks the server whether a login is needed and whether the
+// browser already has a valid session cookie.
+const checkSession = async () => {
+  try {
+    const response = await fetch('/api/session');
+    if (!response.ok) {
+      throw new Error(`Session check failed with status: ${response.status}`);
+    }
+    const session = await response.json();
+    authRequired.value = session.auth_required;
+    authenticated.value = session.authenticated;
+    user.value = session.user || null;
+  } catch (error) {
+    console.error('Session check error:', error);
+  } finally {
+    checked.value = true;
+  }
+};
+
+// login accepts an account's user name and password, or an access token as
+// password with an empty user name.
+const login = async (username, password) => {
+  const response = await fetch('/api/login', {
+    method: 'POST',
+    headers: { 'Content-Type': 'application/json' },
+    body: JSON.stringify({ username, password }),
+  });
+  const { t } = useI18n();
+  if (response.status === 429) {
+    throw new Error(t('ui.login_throttled'));
+  }
+  if (!response.ok) {
+    throw new Error(t('ui.login_failed'));
+  }
+  const session = await response.json();
+  user.value = session.user || null;
+  authenticated.value = true;
+};
+
+const logout = async () => {
+  try {
+    await fetch('/api/logout', { method: 'POST' });
+  } finally {
+    // Reloading drops the websocket connection and all scan state.
+    window.location.reload();
+  }
+};
+
+export function useAuth() {
+  return {
+    authRequired,
+    authenticated,
+    checked,
+    user,
+    checkSession,
+    login,
+    logout,
+  };
+}
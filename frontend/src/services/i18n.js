@@ -0,0 +1,67 @@
+import { ref } from 'vue';
+
+// The UI texts come from the server's translation catalogs, the same ones
+// it renders scan status and error texts with, so both always agree.
+const STORAGE_KEY = 'subsonic-language';
+
+const language = ref('');
+const languages = ref([]);
+const texts = ref({});
+
+const loadCatalog = async (lang) => {
+  const response = await fetch(`/api/i18n/${encodeURIComponent(lang)}`);
+  if (!response.ok) {
+    throw new Error(`Loading catalog ${lang} failed with status: ${response.status}`);
+  }
+  texts.value = await response.json();
+  language.value = lang;
+  document.documentElement.lang = lang;
+};
+
+// initI18n loads the catalog of the language picked earlier, or else the
+// one the server chose from the browser's languages.
+const initI18n = async () => {
+  try {
+    const response = await fetch('/api/i18n');
+    if (!response.ok) {
+      throw new Error(`Loading languages failed with status: ${response.status}`);
+    }
+    const info = await response.json();
+    languages.value = info.languages;
+    const stored = localStorage.getItem(STORAGE_KEY);
+    const known = info.languages.some((l) => l.code === stored);
+    await loadCatalog(known ? stored : info.preferred);
+  } catch (error) {
+    console.error('Translation catalog error:', error);
+  }
+};
+
+const setLanguage = async (lang) => {
+  try {
+    await loadCatalog(lang);
+    localStorage.setItem(STORAGE_KEY, lang);
+  } catch (error) {
+    console.error('Translation catalog error:', error);
+  }
+};
+
+const has = (key) => key in texts.value;
+
+// t renders the text for key with params filled into its {name}
+// placeholders. Keys the catalog lacks are shown as they are.
+const t = (key, params = {}) => {
+  const text = texts.value[key];
+  if (text === undefined) return key;
+  return text.replace(/\{(\w+)\}/g, (match, name) => (name in params ? String(params[name]) : match));
+};
+
+export function useI18n() {
+  return {
+    language,
+    languages,
+    initI18n,
+    setLanguage,
+    has,
+    t,
+  };
+}
@@ -1,8 +1,14 @@
 import { ref } from 'vue';
+import { useI18n } from './i18n';
 
 const socket = ref(null);
 const isConnected = ref(false);
 const messageHandlers = new Map();
+const connectHandlers = [];
+
+// PROTOCOL_VERSION is the version of the server protocol this client speaks.
+const PROTOCOL_VERSION = 1;
+let nextRequestId = 1;
 
 const connect = () => {
   if (isConnected.value) return;
@@ -16,13 +22,20 @@ const connect = () => {
   socket.value.onopen = () => {
     isConnected.value = true;
     console.log('WebSocket connected');
+    // The server only accepts commands after the handshake; messages are
+    // handled in order, so commands may follow right away. The page renders
+    // texts itself from their keys, but asks for its language anyway so the
+    // server's own renderings match.
+    const { language } = useI18n();
+    sendMessage('hello', { protocol_version: PROTOCOL_VERSION, client: 'subsonic-web', language: language.value });
+    connectHandlers.forEach((handler) => handler());
   };
 
   socket.value.onmessage = (event) => {
     try {
       const data = JSON.parse(event.data);
       if (data.type && messageHandlers.has(data.type)) {
-        messageHandlers.get(data.type)(data.payload);
+        messageHandlers.get(data.type)(data.payload, data);
       }
     } catch (error) {
       console.error('Error parsing WebSocket message:', error);
@@ -41,20 +54,30 @@ const connect = () => {
   };
 };
 
+// sendMessage sends a command and returns its request ID, which the
+// server's answers carry as `id`.
 const sendMessage = (type, payload) => {
   if (!isConnected.value) {
     console.error('WebSocket is not connected.');
-    return;
+    return null;
   }
-  const message = JSON.stringify({ type, payload });
+  const id = String(nextRequestId++);
+  const message = JSON.stringify({ type, id, payload });
   console.log('Sending message:', message); // Log the message to the console
   socket.value.send(message);
+  return id;
 };
 
 const on = (messageType, handler) => {
   messageHandlers.set(messageType, handler);
 };
 
+// onConnect registers a handler run every time the connection is
+// (re)established, e.g. to resubscribe to a scan.
+const onConnect = (handler) => {
+  connectHandlers.push(handler);
+};
+
 export function useWebSocket() {
   if (!socket.value) {
     connect();
@@ -63,5 +86,6 @@ export function useWebSocket() {
     isConnected,
     sendMessage,
     on,
+    onConnect,
   };
 }
@@ -1,47 +1,122 @@
 import { defineStore } from 'pinia';
-import { ref } from 'vue';
+import { computed, ref } from 'vue';
 import { useWebSocket } from '../services/websocket';
+import { useI18n } from '../services/i18n';
 
 export const useScanStore = defineStore('scan', () => {
   const results = ref([]);
-  const status = ref('idle'); // idle, scanning, done
-  const message = ref('');
+  const status = ref('idle'); // idle, scanning, done, error
   const progress = ref(0);
   const failedCount = ref(0);
-  const summary = ref('');
   const phase = ref('idle'); // idle, main_scan, retry_scan, done
   const totalRetrying = ref(0);
+  const errorCode = ref('');
+  // The scan this page started. Other scans of the same user, e.g. from
+  // another tab, are ignored.
+  const scanId = ref('');
+  // Seed the scan's wordlist is shuffled with, to repeat its query order.
+  const shuffleSeed = ref(0);
+  // Request ID of the start_scan command awaiting its scan_started.
+  let startRequest = null;
+  // Sequence number of the last result received, to resume from after a
+  // reconnect.
+  let lastSeq = 0;
 
-  const { sendMessage, on } = useWebSocket();
+  const { sendMessage, on, onConnect } = useWebSocket();
+  const { has, t } = useI18n();
 
-  on('scan_results', (payload) => {
-    // payload is now an array of results
-    results.value.push(...payload);
+  // Texts from the server are kept as catalog keys and parameters, so they
+  // follow language changes. The server's own rendering is shown for keys
+  // the catalog lacks, e.g. from a newer server.
+  const text = (key, params, rendered) => ({ key: key || '', params: params || {}, rendered: rendered || '' });
+  const show = ({ key, params, rendered }) => (key && has(key) ? t(key, params) : rendered);
+  const messageText = ref(text());
+  const summaryText = ref(text());
+  const message = computed(() => show(messageText.value));
+  const summary = computed(() => show(summaryText.value));
+
+  onConnect(() => {
+    if (scanId.value) {
+      sendMessage('subscribe_scan', { scan_id: scanId.value, after_seq: lastSeq });
+    }
+  });
+
+  const isOtherScan = (msg) => msg.scan_id && msg.scan_id !== scanId.value;
+
+  on('scan_started', (payload, msg) => {
+    if (startRequest && msg.id === startRequest) {
+      scanId.value = payload.scan_id;
+      shuffleSeed.value = payload.shuffle_seed || 0;
+      startRequest = null;
+    }
   });
 
-  on('scan_status', (payload) => {
+  on('scan_results', (payload, msg) => {
+    if (isOtherScan(msg)) return;
+    // payload is an array of results; after resubscribing, some of them
+    // may already have been received.
+    const first = msg.result_seq - payload.length + 1;
+    const fresh = first > lastSeq ? payload : payload.slice(lastSeq - first + 1);
+    results.value.push(...fresh);
+    lastSeq = Math.max(lastSeq, msg.result_seq);
+  });
+
+  on('scan_status', (payload, msg) => {
+    if (isOtherScan(msg)) return;
     status.value = payload.status;
-    message.value = payload.message;
+    messageText.value = text(payload.key, payload.params, payload.message);
     progress.value = payload.progress;
     failedCount.value = payload.failed || 0;
     phase.value = payload.phase || 'main_scan';
     totalRetrying.value = payload.total_retrying || 0;
 
     if (payload.status === 'done') {
-      summary.value = payload.summary || '';
+      summaryText.value = text(payload.summary_key, payload.params, payload.summary);
       phase.value = 'done';
     }
   });
 
+  on('scan_error', (payload) => {
+    startRequest = null;
+    status.value = 'error';
+    phase.value = 'idle';
+    messageText.value = text(payload.key, payload.params, payload.message);
+    errorCode.value = payload.code;
+  });
+
+  // The server had to drop messages because this page could not keep up.
+  // Resubscribing fetches any missing results from the scan's log and the
+  // current status.
+  on('messages_dropped', (payload) => {
+    console.warn(`Server dropped ${payload.dropped} messages`);
+    if (scanId.value) {
+      sendMessage('subscribe_scan', { scan_id: scanId.value, after_seq: lastSeq });
+    }
+  });
+
+  // Scans still running when the server shuts down end with an interrupted
+  // "done" status first; this only covers a scan that had not started yet.
+  on('server_shutdown', (payload) => {
+    if (status.value !== 'scanning') return;
+    startRequest = null;
+    status.value = 'error';
+    phase.value = 'idle';
+    messageText.value = text(payload.key, null, payload.message);
+  });
+
   function startScan(domain, wordlist, dnsServers, scanOptions) {
     results.value = [];
     status.value = 'scanning';
-    message.value = '正在开始扫描...';
+    messageText.value = text('ui.starting_scan');
     progress.value = 0;
     failedCount.value = 0;
-    summary.value = '';
+    summaryText.value = text();
     phase.value = 'main_scan';
     totalRetrying.value = 0;
+    errorCode.value = '';
+    scanId.value = '';
+    shuffleSeed.value = 0;
+    lastSeq = 0;
 
     const payload = {
       domain,
@@ -49,19 +124,42 @@ export const useScanStore = defineStore('scan', () => {
       adaptive: scanOptions.adaptive,
       maxQPS: scanOptions.maxQPS,
       enable_retry: scanOptions.enableRetry,
+      permutations: scanOptions.permutations,
+      shuffle: scanOptions.shuffle,
+      prioritize_learned: scanOptions.prioritizeLearned,
     };
 
     if (Array.isArray(wordlist)) {
       payload.wordlist = wordlist;
     } else {
       payload.wordlist_key = wordlist;
+      if (scanOptions.extraWordlists && scanOptions.extraWordlists.length > 0) {
+        payload.wordlist_keys = scanOptions.extraWordlists;
+      }
+    }
+
+    if (scanOptions.shard && scanOptions.shard.trim()) {
+      payload.shard = scanOptions.shard.trim();
+      payload.shard_mode = scanOptions.shardMode;
+    }
+
+    if (scanOptions.template) {
+      payload.template = scanOptions.template;
+    }
+
+    if (scanOptions.recursionDepth > 0) {
+      payload.recursion_depth = scanOptions.recursionDepth;
+      const labels = scanOptions.recursionLabels.split(',').map(s => s.trim()).filter(Boolean);
+      if (labels.length > 0) {
+        payload.recursion_labels = labels;
+      }
     }
 
     if (dnsServers && dnsServers.length > 0) {
       payload.dns_servers = dnsServers;
     }
 
-    sendMessage('start_scan', payload);
+    startRequest = sendMessage('start_scan', payload);
   }
 
   function clearResults() {
@@ -77,6 +175,9 @@ export const useScanStore = defineStore('scan', () => {
     summary,
     phase,
     totalRetrying,
+    errorCode,
+    scanId,
+    shuffleSeed,
     startScan,
     clearResults,
   };
@@ -0,0 +1,39 @@
+package scanner
+
+import "strings"
+
+// MaxNameLength is the maximum length of a name in its text form.
+const MaxNameLength = 253
+
+// ValidName reports whether name is a sequence of valid hostname labels
+// separated by dots, no longer than MaxNameLength.
+func ValidName(name string) bool {
+	if len(name) > MaxNameLength {
+		return false
+	}
+	for _, label := range strings.Split(name, ".") {
+		if !ValidLabel(label) {
+			return false
+		}
+	}
+	return true
+}
+
+// ValidLabel reports whether label is a valid hostname label: 1 to 63
+// lowercase letters, digits, hyphens and underscores, neither starting nor
+// ending with a hyphen.
+func ValidLabel(label string) bool {
+	if len(label) == 0 || len(label) > 63 {
+		return false
+	}
+	if label[0] == '-' || label[len(label)-1] == '-' {
+		return false
+	}
+	for i := 0; i < len(label); i++ {
+		c := label[i]
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
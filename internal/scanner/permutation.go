@@ -0,0 +1,241 @@
+package scanner
+
+import (
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// defaultPermutationWords are inserted into and swapped with the labels of
+// discovered names when no custom list is given.
+var defaultPermutationWords = []string{
+	"dev", "test", "stg", "staging", "uat", "qa", "prod", "pre", "beta",
+	"api", "admin", "internal", "int", "old", "new", "v1", "v2", "backup",
+}
+
+const (
+	// maxNumberShift is how far numbers found in labels are moved up and down.
+	maxNumberShift = 3
+	// maxCombineTokens bounds the tokens used for pairwise combination, which
+	// is quadratic in the number of distinct tokens.
+	maxCombineTokens = 64
+)
+
+var labelSeparators = []string{"-", "_", ".", ""}
+
+// runPermutations resolves alterations of every name found so far. It
+// returns false if there was nothing to permute.
+func (s *scheduler) runPermutations() bool {
+	s.mu.Lock()
+	names := make([]string, 0, len(s.seen))
+	for name := range s.seen {
+		names = append(names, name)
+	}
+	s.mu.Unlock()
+
+	words := s.opts.PermutationWords
+	if len(words) == 0 {
+		words = defaultPermutationWords
+	}
+	candidates := s.dropWildcardChildren(generatePermutations(names, s.domain, words), names)
+	if len(candidates) == 0 {
+		log.Println("No permutation candidates generated.")
+		return false
+	}
+
+	log.Printf("Starting permutation scan phase for %d candidates from %d names...", len(candidates), len(names))
+	s.depth = 0
+	tasksChan := s.startPhase("permutation_scan", len(candidates))
+	for _, candidate := range candidates {
+		s.enqueue(tasksChan, candidate)
+	}
+	s.finishPhase(tasksChan)
+	log.Println("Permutation scan phase finished.")
+
+	s.retryFailed()
+	return true
+}
+
+// dropWildcardChildren removes candidates whose parent name is a wildcard,
+// since they would all resolve without telling anything. Only parents among
+// the discovered names are probed; any other parent was never seen to exist.
+func (s *scheduler) dropWildcardChildren(candidates, discovered []string) []string {
+	known := make(map[string]struct{}, len(discovered))
+	for _, name := range discovered {
+		known[name] = struct{}{}
+	}
+	var parents []string
+	probed := make(map[string]struct{})
+	for _, candidate := range candidates {
+		_, parent, _ := strings.Cut(candidate, ".")
+		if _, ok := known[parent]; !ok || parent == s.domain {
+			continue
+		}
+		if _, ok := probed[parent]; !ok {
+			probed[parent] = struct{}{}
+			parents = append(parents, parent)
+		}
+	}
+	wildcards := s.probeWildcards(parents)
+
+	kept := candidates[:0]
+	for _, candidate := range candidates {
+		_, parent, _ := strings.Cut(candidate, ".")
+		if wildcards[parent] {
+			continue
+		}
+		kept = append(kept, candidate)
+	}
+	return kept
+}
+
+// generatePermutations derives new candidate names below domain from the
+// known names, in the spirit of altdns/dnsgen: word insertion and
+// replacement, number shifting, separator swapping and token combination.
+// Known names and invalid labels are excluded from the result.
+func generatePermutations(names []string, domain string, words []string) []string {
+	suffix := "." + domain
+	known := make(map[string]struct{}, len(names))
+	candidates := make(map[string]struct{})
+	tokenSet := make(map[string]struct{})
+
+	add := func(sub string) {
+		if sub == "" || !ValidName(sub) {
+			return
+		}
+		candidates[sub+suffix] = struct{}{}
+	}
+
+	var subs []string
+	for _, name := range names {
+		known[name] = struct{}{}
+		sub := strings.TrimSuffix(name, suffix)
+		if sub == name || sub == "" {
+			continue
+		}
+		subs = append(subs, sub)
+	}
+
+	for _, sub := range subs {
+		labels := strings.Split(sub, ".")
+		first, rest := labels[0], strings.Join(labels[1:], ".")
+		withRest := func(label string) string {
+			if rest == "" {
+				return label
+			}
+			return label + "." + rest
+		}
+
+		for _, word := range words {
+			// Insert the word as a new label at every position.
+			for i := 0; i <= len(labels); i++ {
+				inserted := append(append(append([]string{}, labels[:i]...), word), labels[i:]...)
+				add(strings.Join(inserted, "."))
+			}
+			// Prefix and suffix the leftmost label.
+			for _, sep := range []string{"-", ""} {
+				add(withRest(word + sep + first))
+				add(withRest(first + sep + word))
+			}
+		}
+
+		tokens := splitTokens(first)
+		for _, token := range tokens {
+			tokenSet[token] = struct{}{}
+		}
+
+		// Replace each token of the leftmost label with every word.
+		for i := range tokens {
+			for _, word := range words {
+				if word == tokens[i] {
+					continue
+				}
+				replaced := append([]string{}, tokens...)
+				replaced[i] = word
+				add(withRest(strings.Join(replaced, "-")))
+			}
+		}
+
+		// Shift numbers up and down, or append one when there is none.
+		for _, label := range shiftNumbers(first) {
+			add(withRest(label))
+		}
+
+		// Rejoin the tokens with every separator.
+		if len(tokens) > 1 {
+			for _, sep := range labelSeparators {
+				add(withRest(strings.Join(tokens, sep)))
+			}
+		}
+	}
+
+	// Combine distinct tokens pairwise.
+	tokens := make([]string, 0, len(tokenSet))
+	for token := range tokenSet {
+		tokens = append(tokens, token)
+	}
+	sort.Strings(tokens)
+	if len(tokens) > maxCombineTokens {
+		tokens = tokens[:maxCombineTokens]
+	}
+	for _, a := range tokens {
+		for _, b := range tokens {
+			if a != b {
+				add(a + "-" + b)
+			}
+		}
+	}
+
+	result := make([]string, 0, len(candidates))
+	for candidate := range candidates {
+		if _, ok := known[candidate]; !ok {
+			result = append(result, candidate)
+		}
+	}
+	sort.Strings(result)
+	return result
+}
+
+// splitTokens splits a label on the separators used inside DNS labels.
+func splitTokens(label string) []string {
+	return strings.FieldsFunc(label, func(r rune) bool {
+		return r == '-' || r == '_'
+	})
+}
+
+// shiftNumbers returns variations of label with its trailing number moved by
+// up to maxNumberShift, keeping zero padding, or with a number appended when
+// the label does not end in one.
+func shiftNumbers(label string) []string {
+	end := len(label)
+	start := end
+	for start > 0 && label[start-1] >= '0' && label[start-1] <= '9' {
+		start--
+	}
+
+	var out []string
+	if start == end {
+		for n := 1; n <= maxNumberShift; n++ {
+			out = append(out, label+strconv.Itoa(n), label+"-"+strconv.Itoa(n))
+		}
+		return out
+	}
+
+	digits := label[start:end]
+	n, err := strconv.Atoi(digits)
+	if err != nil {
+		return nil
+	}
+	for d := -maxNumberShift; d <= maxNumberShift; d++ {
+		if d == 0 || n+d < 0 {
+			continue
+		}
+		num := strconv.Itoa(n + d)
+		if len(num) < len(digits) {
+			num = strings.Repeat("0", len(digits)-len(num)) + num
+		}
+		out = append(out, label[:start]+num)
+	}
+	return out
+}
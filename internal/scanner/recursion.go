@@ -0,0 +1,174 @@
+package scanner
+
+import (
+	"fmt"
+	"log"
+	"math/rand"
+	"strings"
+	"sync"
+)
+
+// wildcardProbes is the number of random labels resolved under a base before
+// it is brute-forced. A single hit marks the base as a wildcard.
+const wildcardProbes = 2
+
+// markDiscovered records a resolved name for the recursive and permutation
+// phases. It reports false if the name has already been reported during this
+// scan.
+func (s *scheduler) markDiscovered(subdomain string) bool {
+	if s.seen == nil {
+		return true
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.seen[subdomain]; ok {
+		return false
+	}
+	s.seen[subdomain] = struct{}{}
+	s.discovered = append(s.discovered, subdomain)
+	return true
+}
+
+// runRecursion brute-forces the recursion wordlist under every name found
+// since the previous level. It returns false when there is nothing left to
+// recurse into.
+func (s *scheduler) runRecursion(depth int) bool {
+	bases := s.nextBases()
+	if len(bases) == 0 {
+		log.Printf("No new names to recurse into at depth %d.", depth)
+		return false
+	}
+
+	log.Printf("Starting recursive scan phase at depth %d for %d names...", depth, len(bases))
+	s.depth = depth
+	tasksChan := s.startPhase("recursive_scan", len(bases)*s.opts.RecursionWordCount)
+	for _, base := range bases {
+		if s.stopped() {
+			break
+		}
+		for word := range s.opts.RecursionWordlist() {
+			if s.stopped() {
+				break
+			}
+			s.opts.Template.Expand(word, func(sub string) {
+				s.enqueue(tasksChan, fmt.Sprintf("%s.%s", sub, base))
+			})
+		}
+	}
+	s.finishPhase(tasksChan)
+	log.Printf("Recursive scan phase at depth %d finished.", depth)
+
+	s.retryFailed()
+	return true
+}
+
+// nextBases drains the names discovered since the last level and returns the
+// ones that pass the label allowlist, have not been expanded yet and are not
+// wildcards.
+func (s *scheduler) nextBases() []string {
+	s.mu.Lock()
+	candidates := s.discovered
+	s.discovered = nil
+	s.mu.Unlock()
+
+	var allowed []string
+	for _, name := range candidates {
+		if _, ok := s.expanded[name]; ok {
+			continue
+		}
+		s.expanded[name] = struct{}{}
+
+		if s.labelAllowed(name) {
+			allowed = append(allowed, name)
+		}
+	}
+
+	wildcards := s.probeWildcards(allowed)
+	var bases []string
+	for _, name := range allowed {
+		if wildcards[name] {
+			log.Printf("Skipping wildcard name %s during recursion.", name)
+			continue
+		}
+		bases = append(bases, name)
+	}
+	return bases
+}
+
+func (s *scheduler) labelAllowed(name string) bool {
+	if len(s.opts.RecursionLabels) == 0 {
+		return true
+	}
+	label, _, _ := strings.Cut(name, ".")
+	for _, allowed := range s.opts.RecursionLabels {
+		if strings.EqualFold(label, allowed) {
+			return true
+		}
+	}
+	return false
+}
+
+// probeWildcards resolves random labels under each of bases; any answer
+// means every name below that base would resolve and brute-forcing it is
+// pointless. Results are cached for the rest of the scan. The uncached
+// bases are probed concurrently, by as many goroutines as the scan's
+// minimum number of workers.
+func (s *scheduler) probeWildcards(bases []string) map[string]bool {
+	wildcards := make(map[string]bool, len(bases))
+	var pending []string
+	for _, base := range bases {
+		if wildcard, ok := s.wildcards[base]; ok {
+			wildcards[base] = wildcard
+		} else {
+			pending = append(pending, base)
+		}
+	}
+	if len(pending) == 0 {
+		return wildcards
+	}
+
+	log.Printf("Probing %d discovered names for wildcards...", len(pending))
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, max(int(s.minConcurrency), 1))
+	for _, base := range pending {
+		slots <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			wildcard := s.probeWildcard(base)
+			<-slots
+			mu.Lock()
+			wildcards[base] = wildcard
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	for _, base := range pending {
+		s.wildcards[base] = wildcards[base]
+	}
+	return wildcards
+}
+
+func (s *scheduler) probeWildcard(base string) bool {
+	for i := 0; i < wildcardProbes; i++ {
+		if s.limiter != nil && s.limiter.Wait(s.ctx) != nil {
+			return false
+		}
+		_, status, _, _ := s.resolver.Resolve(s.ctx, fmt.Sprintf("%s.%s", randomLabel(12), base))
+		if status == Success {
+			return true
+		}
+	}
+	return false
+}
+
+func randomLabel(n int) string {
+	const letters = "abcdefghijklmnopqrstuvwxyz0123456789"
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = letters[rand.Intn(len(letters))]
+	}
+	return string(b)
+}
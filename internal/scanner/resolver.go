@@ -1,6 +1,7 @@
 package scanner
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"math/rand"
@@ -86,7 +87,8 @@ func selectServer(servers []string, usedServers map[string]bool) (string, bool)
 }
 
 // Resolve performs a DNS A record lookup and returns ip, status, attempts, and error.
-func (r *Resolver) Resolve(domain string) (string, ResolveStatus, int, error) {
+// Once ctx is cancelled it stops waiting for replies and reports Failed.
+func (r *Resolver) Resolve(ctx context.Context, domain string) (string, ResolveStatus, int, error) {
 	msg := new(dns.Msg)
 	msg.SetQuestion(dns.Fqdn(domain), dns.TypeA)
 	msg.RecursionDesired = true
@@ -110,7 +112,10 @@ func (r *Resolver) Resolve(domain string) (string, ResolveStatus, int, error) {
 		}
 		usedServers[server] = true
 
-		reply, _, err := r.dnsClient.Exchange(msg, server)
+		reply, err := r.exchange(ctx, msg, server)
+		if ctx.Err() != nil {
+			return "", Failed, attempt, ctx.Err()
+		}
 		lastErr = err
 		isNetworkError = false
 
@@ -131,7 +136,11 @@ func (r *Resolver) Resolve(domain string) (string, ResolveStatus, int, error) {
 			if r.debugNetwork {
 				log.Printf("Network error for %s using %s (attempt %d/%d): %v. Retrying...", domain, server, attempt, maxAttempts, err)
 			}
-			time.Sleep(retryDelay)
+			select {
+			case <-time.After(retryDelay):
+			case <-ctx.Done():
+				return "", Failed, attempt, ctx.Err()
+			}
 			continue
 		}
 
@@ -142,5 +151,19 @@ func (r *Resolver) Resolve(domain string) (string, ResolveStatus, int, error) {
 		return "", Failed, maxAttempts, fmt.Errorf("all %d attempts failed for %s; last network error: %w", maxAttempts, domain, lastErr)
 	}
 	
-	return "", NotFound, maxAttempts, fmt.Errorf("all attempts failed for %s without a definitive result; last error: %w", maxAttempts, domain, lastErr)
+	return "", NotFound, maxAttempts, fmt.Errorf("all %d attempts failed for %s without a definitive result; last error: %w", maxAttempts, domain, lastErr)
+}
+
+// exchange is dns.Client.Exchange, except that it gives up as soon as ctx
+// is cancelled; the library only honours a context's deadline.
+func (r *Resolver) exchange(ctx context.Context, msg *dns.Msg, server string) (*dns.Msg, error) {
+	conn, err := r.dnsClient.DialContext(ctx, server)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+	reply, _, err := r.dnsClient.ExchangeWithConnContext(ctx, msg, conn)
+	return reply, err
 }
@@ -1,5 +1,7 @@
 package scanner
 
+import "context"
+
 // Scanner is the main struct for the scanning engine.
 type Scanner struct {
 	resolver     *Resolver
@@ -22,6 +24,40 @@ type ScanStatus struct {
 	TotalRetries  int
 	Phase         string
 	TotalRetrying int
+	Depth         int
+	// Queried is the number of names queried in all phases so far, not
+	// counting retries.
+	Queried int
+}
+
+// Options controls how a scan is scheduled.
+type Options struct {
+	Concurrency int
+	Adaptive    bool
+	MaxQPS      int
+	EnableRetry bool
+
+	// Template expands each wordlist entry into the labels queried under the
+	// target. Nil uses every entry as-is as the leftmost label.
+	Template *Template
+
+	// RecursionDepth is the number of levels below the target domain that
+	// discovered names are brute-forced again. Zero disables recursion.
+	RecursionDepth int
+	// RecursionLabels, when not empty, restricts recursion to discovered
+	// names whose leftmost label is in the list (e.g. "dev", "staging").
+	RecursionLabels []string
+	// RecursionWordlist opens a fresh stream of words for every recursive
+	// base. RecursionWordCount is the number of names it yields per base
+	// once expanded by Template. A stream is abandoned unread when the scan
+	// is cancelled, so it has to stop on its own then.
+	RecursionWordlist  func() <-chan string
+	RecursionWordCount int
+
+	// Permutations enables a final phase that resolves alterations of the
+	// names found so far. PermutationWords overrides the built-in word list.
+	Permutations     bool
+	PermutationWords []string
 }
 
 // NewScanner creates a new Scanner instance.
@@ -37,8 +73,11 @@ func (s *Scanner) SetDNSServers(servers []string) {
 	s.resolver.SetDNSServers(servers)
 }
 
-// Start begins the subdomain scanning process.
-func (s *Scanner) Start(domain string, wordlistChan <-chan string, totalTasks int, resultsChan chan<- *ScanResult, statusChan chan<- ScanStatus, concurrency int, adaptive bool, maxQPS int, enableRetry bool) {
-	scheduler := newScheduler(s.resolver, domain, wordlistChan, totalTasks, resultsChan, statusChan, concurrency, adaptive, maxQPS)
-	scheduler.run(enableRetry)
+// Start begins the subdomain scanning process. Cancelling ctx stops the scan
+// early: no new names are queried, later phases are skipped and the results
+// and status channels are closed as for a completed scan, after the final
+// "done" status.
+func (s *Scanner) Start(ctx context.Context, domain string, wordlistChan <-chan string, totalTasks int, resultsChan chan<- *ScanResult, statusChan chan<- ScanStatus, opts Options) {
+	scheduler := newScheduler(ctx, s.resolver, domain, wordlistChan, totalTasks, resultsChan, statusChan, opts)
+	scheduler.run()
 }
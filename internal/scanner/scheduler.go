@@ -14,16 +14,19 @@ import (
 const (
 	// Guaranteed minimum concurrency for adaptive mode unless user specifies a lower value.
 	guaranteedMinConcurrency = 150
-	maxConcurrency           = 5000
-	adjustInterval           = 2 * time.Second
+	// MaxConcurrency is the upper bound on concurrent workers.
+	MaxConcurrency = 5000
+	adjustInterval = 2 * time.Second
 )
 
 type scheduler struct {
+	ctx          context.Context
 	resolver     *Resolver
 	domain       string
 	wordlistChan <-chan string
 	resultsChan  chan<- *ScanResult
 	statusChan   chan<- ScanStatus
+	opts         Options
 	adaptive     bool
 	limiter      *rate.Limiter
 
@@ -31,8 +34,12 @@ type scheduler struct {
 	totalTasks    int
 	scanned       int32
 	failed        int32
+	unresolved    int32
 	totalRequests int32
 	totalRetries  int32
+	// queried counts the names queried by the phases before the current
+	// one, leaving out retries.
+	queried int
 
 	activeWorkers  int32
 	minConcurrency int32
@@ -41,16 +48,32 @@ type scheduler struct {
 	totalResolutions   int32
 	retriedResolutions int32
 
+	// Current phase state, written by run() between phases.
+	phase         string
+	depth         int
+	totalRetrying int
+	tasksChan     chan string
+
 	// For retry logic
 	failedDomains []string
 	mu            sync.Mutex
 
+	// For recursion and permutation: names found since the last recursive
+	// level, every name reported so far, every base that has already been
+	// brute-forced and the outcome of wildcard checks.
+	discovered []string
+	seen       map[string]struct{}
+	expanded   map[string]struct{}
+	wildcards  map[string]bool
+
 	// Channels for signaling
 	stopChan chan struct{} // Signals workers to stop
 	quitChan chan struct{} // Signals the monitor to quit
 }
 
-func newScheduler(resolver *Resolver, domain string, wordlistChan <-chan string, totalTasks int, resultsChan chan<- *ScanResult, statusChan chan<- ScanStatus, concurrency int, adaptive bool, maxQPS int) *scheduler {
+func newScheduler(ctx context.Context, resolver *Resolver, domain string, wordlistChan <-chan string, totalTasks int, resultsChan chan<- *ScanResult, statusChan chan<- ScanStatus, opts Options) *scheduler {
+	concurrency, adaptive, maxQPS := opts.Concurrency, opts.Adaptive, opts.MaxQPS
+
 	minWorkers := int32(guaranteedMinConcurrency)
 	if !adaptive && concurrency > 0 {
 		minWorkers = int32(concurrency)
@@ -58,7 +81,7 @@ func newScheduler(resolver *Resolver, domain string, wordlistChan <-chan string,
 		// If user provides a custom concurrency lower than the guaranteed minimum, respect it.
 		minWorkers = int32(concurrency)
 	}
-	
+
 	initialConcurrency := minWorkers
 	if !adaptive && concurrency > 0 {
 		initialConcurrency = int32(concurrency)
@@ -69,91 +92,155 @@ func newScheduler(resolver *Resolver, domain string, wordlistChan <-chan string,
 		limiter = rate.NewLimiter(rate.Limit(maxQPS), maxQPS)
 	}
 
-	return &scheduler{
-		resolver:      resolver,
-		domain:        domain,
-		wordlistChan:  wordlistChan,
-		totalTasks:    totalTasks,
-		resultsChan:   resultsChan,
-		statusChan:    statusChan,
-		activeWorkers: initialConcurrency,
+	if opts.Template == nil {
+		opts.Template, _ = ParseTemplate("")
+	}
+	if opts.RecursionWordlist == nil || opts.RecursionWordCount <= 0 {
+		opts.RecursionDepth = 0
+	}
+
+	s := &scheduler{
+		ctx:            ctx,
+		resolver:       resolver,
+		domain:         domain,
+		wordlistChan:   wordlistChan,
+		totalTasks:     totalTasks,
+		resultsChan:    resultsChan,
+		statusChan:     statusChan,
+		opts:           opts,
+		activeWorkers:  initialConcurrency,
 		minConcurrency: minWorkers,
-		adaptive:      adaptive,
-		limiter:       limiter,
-		stopChan:      make(chan struct{}, maxConcurrency),
-		quitChan:      make(chan struct{}),
+		adaptive:       adaptive,
+		limiter:        limiter,
+		stopChan:       make(chan struct{}, MaxConcurrency),
+		quitChan:       make(chan struct{}),
 	}
+	if opts.RecursionDepth > 0 || opts.Permutations {
+		s.seen = make(map[string]struct{})
+		s.expanded = map[string]struct{}{domain: {}}
+		s.wildcards = make(map[string]bool)
+	}
+	return s
 }
 
-func (s *scheduler) run(enableRetry bool) {
+func (s *scheduler) run() {
 	defer close(s.resultsChan)
 	defer close(s.statusChan)
 
-	tasksChan := make(chan string, maxConcurrency)
-
-	// Initial worker setup
-	s.wg.Add(int(s.activeWorkers))
-	for i := 0; i < int(s.activeWorkers); i++ {
-		go s.worker(tasksChan)
-	}
-
 	if s.adaptive {
-		go s.monitorAndAdjust(tasksChan)
+		go s.monitorAndAdjust()
 	}
 
 	// --- Phase 1: Main Scan ---
 	log.Println("Starting main scan phase...")
-	s.sendStatus("main_scan", 0)
+	tasksChan := s.startPhase("main_scan", s.totalTasks)
 	for word := range s.wordlistChan {
-		tasksChan <- fmt.Sprintf("%s.%s", word, s.domain)
+		if s.stopped() {
+			break
+		}
+		s.opts.Template.Expand(word, func(sub string) {
+			s.enqueue(tasksChan, fmt.Sprintf("%s.%s", sub, s.domain))
+		})
 	}
-	close(tasksChan)
-	s.wg.Wait()
+	s.finishPhase(tasksChan)
 	log.Println("Main scan phase finished.")
 
-	// --- Decision Point ---
-	if !enableRetry || len(s.failedDomains) == 0 {
-		log.Println("No retry needed or feature disabled. Finishing scan.")
-		if s.adaptive {
-			close(s.quitChan) // Signal monitor to stop
+	// --- Phase 2: Retry Scan ---
+	s.retryFailed()
+
+	// --- Phase 3: Recursive Scan ---
+	for depth := 1; depth <= s.opts.RecursionDepth && !s.stopped(); depth++ {
+		if !s.runRecursion(depth) {
+			break
 		}
-		s.sendStatus("done", 0)
-		return
 	}
 
-	// --- Phase 2: Retry Scan ---
-	log.Printf("Starting retry phase for %d failed domains...", len(s.failedDomains))
-	retryTasks := s.failedDomains
-	s.failedDomains = nil // Clear the slice
-	s.totalTasks = len(retryTasks)
-	atomic.StoreInt32(&s.scanned, 0)
-	atomic.StoreInt32(&s.failed, 0)
+	// --- Phase 4: Permutation Scan ---
+	if s.opts.Permutations && !s.stopped() {
+		s.runPermutations()
+	}
 
-	s.sendStatus("retry_scan", s.totalTasks)
+	if s.stopped() {
+		log.Println("Scan cancelled.")
+	}
+
+	if s.adaptive {
+		close(s.quitChan) // Signal monitor to stop
+	}
+	s.queried = s.queriedNames()
+	s.phase = "done"
+	s.sendStatus()
+}
 
-	tasksChan = make(chan string, maxConcurrency)
+// startPhase resets the per-phase counters, launches the workers and returns
+// the channel the phase's tasks must be fed into.
+func (s *scheduler) startPhase(phase string, total int) chan string {
+	tasksChan := make(chan string, MaxConcurrency)
+	s.queried = s.queriedNames()
 
-	// Relaunch workers for the retry phase
-	s.wg.Add(int(s.activeWorkers))
-	for i := 0; i < int(s.activeWorkers); i++ {
+	s.mu.Lock()
+	s.phase = phase
+	s.tasksChan = tasksChan
+	s.mu.Unlock()
+
+	s.totalTasks = total
+	atomic.StoreInt32(&s.scanned, 0)
+	atomic.StoreInt32(&s.failed, 0)
+	s.sendStatus()
+
+	workers := int(atomic.LoadInt32(&s.activeWorkers))
+	s.wg.Add(workers)
+	for i := 0; i < workers; i++ {
 		go s.worker(tasksChan)
 	}
+	return tasksChan
+}
 
-	// Start a goroutine to feed the retry tasks
-	go func() {
-		for _, domain := range retryTasks {
-			tasksChan <- domain
-		}
-		close(tasksChan)
-	}()
+// enqueue hands name to the phase's workers unless the scan is cancelled
+// first.
+func (s *scheduler) enqueue(tasksChan chan<- string, name string) {
+	select {
+	case tasksChan <- name:
+	case <-s.ctx.Done():
+	}
+}
+
+// stopped reports whether the scan has been cancelled.
+func (s *scheduler) stopped() bool {
+	return s.ctx.Err() != nil
+}
 
+// finishPhase closes the phase's task channel and waits for the workers to drain it.
+func (s *scheduler) finishPhase(tasksChan chan string) {
+	close(tasksChan)
 	s.wg.Wait()
-	log.Println("Retry scan phase finished.")
+}
 
-	if s.adaptive {
-		close(s.quitChan) // Signal monitor to stop
+// retryFailed re-queries the domains that failed in the previous phase, if
+// retries are enabled, and accounts for the ones that remain unresolved.
+func (s *scheduler) retryFailed() {
+	if !s.opts.EnableRetry || len(s.failedDomains) == 0 || s.stopped() {
+		log.Println("No retry needed or feature disabled.")
+		atomic.AddInt32(&s.unresolved, int32(len(s.failedDomains)))
+		s.failedDomains = nil
+		return
+	}
+
+	log.Printf("Starting retry phase for %d failed domains...", len(s.failedDomains))
+	retryTasks := s.failedDomains
+	s.failedDomains = nil // Clear the slice
+	s.totalRetrying = len(retryTasks)
+
+	tasksChan := s.startPhase("retry_scan", len(retryTasks))
+	for _, domain := range retryTasks {
+		s.enqueue(tasksChan, domain)
 	}
-	s.sendStatus("done", 0)
+	s.finishPhase(tasksChan)
+	s.totalRetrying = 0
+	log.Println("Retry scan phase finished.")
+
+	atomic.AddInt32(&s.unresolved, int32(len(s.failedDomains)))
+	s.failedDomains = nil
 }
 
 func (s *scheduler) worker(tasksChan <-chan string) {
@@ -161,15 +248,20 @@ func (s *scheduler) worker(tasksChan <-chan string) {
 	for {
 		select {
 		case subdomain, ok := <-tasksChan:
-			if !ok {
+			if !ok || s.stopped() {
 				return
 			}
 
-			if s.limiter != nil {
-				s.limiter.Wait(context.Background())
+			if s.limiter != nil && s.limiter.Wait(s.ctx) != nil {
+				return
 			}
 
-			ip, status, attempts, _ := s.resolver.Resolve(subdomain)
+			ip, status, attempts, _ := s.resolver.Resolve(s.ctx, subdomain)
+			if s.stopped() {
+				// Cut short by the cancellation, which says nothing about
+				// the name.
+				return
+			}
 
 			atomic.AddInt32(&s.scanned, 1)
 			atomic.AddInt32(&s.totalRequests, int32(attempts))
@@ -187,7 +279,7 @@ func (s *scheduler) worker(tasksChan <-chan string) {
 
 			atomic.AddInt32(&s.totalResolutions, 1)
 
-			if status == Success && ip != "" {
+			if status == Success && ip != "" && s.markDiscovered(subdomain) {
 				result := GetScanResult()
 				result.Subdomain = subdomain
 				result.IPAddress = ip
@@ -195,19 +287,17 @@ func (s *scheduler) worker(tasksChan <-chan string) {
 			}
 
 			if atomic.LoadInt32(&s.scanned)%1000 == 0 || int(atomic.LoadInt32(&s.scanned)) == s.totalTasks {
-				// Status sending logic is now phase-dependent, handled in run()
-				// For simplicity, we'll send status based on the main task count during main scan
-				// and based on retry count during retry scan.
-				// A more robust implementation might check the phase here.
-				s.sendStatus("", 0) // Phase will be determined by the receiver context now
+				s.sendStatus()
 			}
 		case <-s.stopChan:
 			return
+		case <-s.ctx.Done():
+			return
 		}
 	}
 }
 
-func (s *scheduler) monitorAndAdjust(tasksChan chan string) {
+func (s *scheduler) monitorAndAdjust() {
 	ticker := time.NewTicker(adjustInterval)
 	defer ticker.Stop()
 
@@ -226,18 +316,18 @@ func (s *scheduler) monitorAndAdjust(tasksChan chan string) {
 			currentConcurrency := atomic.LoadInt32(&s.activeWorkers)
 			log.Printf("[Adaptive] Retry Rate: %.2f%% | Current Concurrency: %d", retryRate*100, currentConcurrency)
 
-			if retryRate < 0.20 && currentConcurrency < maxConcurrency { // Healthy Zone
+			if retryRate < 0.20 && currentConcurrency < MaxConcurrency { // Healthy Zone
 				log.Println("[Adaptive] Healthy zone, increasing concurrency by 40.")
-				s.adjustWorkers(40, tasksChan)
-			} else if retryRate >= 0.20 && retryRate < 0.50 && currentConcurrency < maxConcurrency { // Pressure Zone
+				s.adjustWorkers(40)
+			} else if retryRate >= 0.20 && retryRate < 0.50 && currentConcurrency < MaxConcurrency { // Pressure Zone
 				log.Println("[Adaptive] Pressure zone, increasing concurrency by 20.")
-				s.adjustWorkers(20, tasksChan)
+				s.adjustWorkers(20)
 			} else if retryRate >= 0.50 && retryRate < 0.70 && currentConcurrency > s.minConcurrency { // Warning Zone
 				log.Println("[Adaptive] Warning zone, decreasing concurrency by 60.")
-				s.adjustWorkers(-60, tasksChan)
+				s.adjustWorkers(-60)
 			} else if retryRate >= 0.70 && currentConcurrency > s.minConcurrency { // Danger Zone
 				log.Println("[Adaptive] Danger zone, decreasing concurrency by 120.")
-				s.adjustWorkers(-120, tasksChan)
+				s.adjustWorkers(-120)
 			}
 
 		case <-s.quitChan:
@@ -247,10 +337,13 @@ func (s *scheduler) monitorAndAdjust(tasksChan chan string) {
 	}
 }
 
-func (s *scheduler) adjustWorkers(delta int, tasksChan chan string) {
+func (s *scheduler) adjustWorkers(delta int) {
 	if delta > 0 {
 		newWorkers := atomic.AddInt32(&s.activeWorkers, int32(delta))
 		log.Printf("[Adaptive] Increasing worker count to %d", newWorkers)
+		s.mu.Lock()
+		tasksChan := s.tasksChan
+		s.mu.Unlock()
 		s.wg.Add(delta)
 		for i := 0; i < delta; i++ {
 			go s.worker(tasksChan)
@@ -258,12 +351,12 @@ func (s *scheduler) adjustWorkers(delta int, tasksChan chan string) {
 	} else if delta < 0 {
 		numToStop := -delta
 		currentWorkers := atomic.LoadInt32(&s.activeWorkers)
-		
+
 		// Ensure we don't go below the guaranteed minimum concurrency
-		if currentWorkers - int32(numToStop) < s.minConcurrency {
+		if currentWorkers-int32(numToStop) < s.minConcurrency {
 			numToStop = int(currentWorkers - s.minConcurrency)
 		}
-		
+
 		if numToStop <= 0 {
 			return
 		}
@@ -276,27 +369,31 @@ func (s *scheduler) adjustWorkers(delta int, tasksChan chan string) {
 	}
 }
 
-func (s *scheduler) sendStatus(phase string, totalRetrying int) {
-	// A bit of a hack to determine phase if not provided, for simplicity.
-	// A better way would be to have the scheduler maintain its current phase in its state.
-	if phase == "" {
-		if len(s.failedDomains) > 0 {
-			phase = "main_scan"
-		} else {
-			// This is ambiguous, could be retry or main. Let's assume main for now.
-			// The main `run` loop will send the definitive phase status.
-			phase = "main_scan"
-		}
+func (s *scheduler) sendStatus() {
+	failed := int(atomic.LoadInt32(&s.failed))
+	if s.phase == "done" {
+		failed = int(atomic.LoadInt32(&s.unresolved))
 	}
 
 	s.statusChan <- ScanStatus{
 		Scanned:       int(atomic.LoadInt32(&s.scanned)),
 		Total:         s.totalTasks,
-		Failed:        int(atomic.LoadInt32(&s.failed)),
+		Failed:        failed,
 		Concurrency:   int(atomic.LoadInt32(&s.activeWorkers)),
 		TotalRequests: int(atomic.LoadInt32(&s.totalRequests)),
 		TotalRetries:  int(atomic.LoadInt32(&s.totalRetries)),
-		Phase:         phase,
-		TotalRetrying: totalRetrying,
+		Phase:         s.phase,
+		TotalRetrying: s.totalRetrying,
+		Depth:         s.depth,
+		Queried:       s.queriedNames(),
+	}
+}
+
+// queriedNames returns the number of names queried so far in all phases.
+// Retries query names that were counted already.
+func (s *scheduler) queriedNames() int {
+	if s.phase == "retry_scan" || s.phase == "done" {
+		return s.queried
 	}
+	return s.queried + int(atomic.LoadInt32(&s.scanned))
 }
@@ -0,0 +1,242 @@
+package scanner
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// maxRangeSize bounds a single numeric range such as {0-20}.
+const maxRangeSize = 100000
+
+// maxExpansion bounds the number of names one wordlist entry may expand to
+// under a template, counting the template's own placeholders. Entries and
+// templates beyond it are rejected, which keeps counts from overflowing.
+const maxExpansion = 1000000
+
+// namedSets are the placeholders that expand to a fixed list of values.
+var namedSets = map[string][]string{
+	"env": {"dev", "test", "qa", "uat", "stg", "staging", "pre", "prod"},
+}
+
+// Template turns wordlist entries into the names that are queried. Patterns
+// are literal text mixed with placeholders in braces:
+//
+//	{word}     the wordlist entry itself
+//	{a,b,c}    each of the listed values
+//	{0-20}     each number in the range; {00-20} pads to the same width
+//	{env}      a built-in set of values
+//
+// Wordlist entries may use the same placeholders (except {word}), so an entry
+// like "api{0-20}" expands to api0 ... api20. Expansion is lazy: names are
+// generated one at a time and never collected in memory.
+type Template struct {
+	segments []segment
+}
+
+type segmentKind int
+
+const (
+	literalSegment segmentKind = iota
+	valuesSegment
+	rangeSegment
+	wordSegment
+)
+
+type segment struct {
+	kind    segmentKind
+	literal string
+	values  []string
+	lo, hi  int
+	width   int
+}
+
+func (g segment) size() int {
+	switch g.kind {
+	case valuesSegment:
+		return len(g.values)
+	case rangeSegment:
+		return g.hi - g.lo + 1
+	}
+	return 1
+}
+
+func (g segment) value(i int) string {
+	switch g.kind {
+	case valuesSegment:
+		return g.values[i]
+	case rangeSegment:
+		n := strconv.Itoa(g.lo + i)
+		if len(n) < g.width {
+			n = strings.Repeat("0", g.width-len(n)) + n
+		}
+		return n
+	}
+	return g.literal
+}
+
+// ParseTemplate parses a scan template. An empty pattern is equivalent to
+// "{word}", i.e. every entry is used as-is as the leftmost label.
+func ParseTemplate(pattern string) (*Template, error) {
+	if pattern == "" {
+		pattern = "{word}"
+	}
+	segments, err := parsePattern(pattern, true)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := expansionSize(segments); !ok {
+		return nil, fmt.Errorf("pattern %q expands to more than %d names per entry", pattern, maxExpansion)
+	}
+	return &Template{segments: segments}, nil
+}
+
+// expansionSize returns the number of names segments expand to, or false if
+// that is more than maxExpansion.
+func expansionSize(segments []segment) (int, bool) {
+	size := 1
+	for _, g := range segments {
+		size *= g.size()
+		if size > maxExpansion {
+			return 0, false
+		}
+	}
+	return size, true
+}
+
+// Count returns the number of names word expands to, without generating
+// them. Entries with an invalid pattern or expanding to more than
+// maxExpansion names count as zero.
+func (t *Template) Count(word string) int {
+	segments, ok := t.bind(word)
+	if !ok {
+		return 0
+	}
+	count, _ := expansionSize(segments)
+	return count
+}
+
+// Scale describes how Count depends on the entry: Count(word) equals factor
+// multiplied by the entry's own expansion count raised to wordRefs, the
+// number of {word} placeholders. It lets callers that know the total
+// expansion count of a list compute its size under t without reading it.
+func (t *Template) Scale() (factor, wordRefs int) {
+	factor = 1
+	for _, g := range t.segments {
+		if g.kind == wordSegment {
+			wordRefs++
+		} else {
+			factor *= g.size()
+		}
+	}
+	return factor, wordRefs
+}
+
+// Expand calls emit for every name word expands to.
+func (t *Template) Expand(word string, emit func(string)) {
+	segments, ok := t.bind(word)
+	if !ok {
+		return
+	}
+	expandSegments(segments, make([]byte, 0, 64), emit)
+}
+
+// bind substitutes the entry's own segments for the {word} placeholder. It
+// fails for entries that are invalid or expand to too many names, which
+// are skipped.
+func (t *Template) bind(word string) ([]segment, bool) {
+	wordSegments := []segment{{kind: literalSegment, literal: word}}
+	if strings.ContainsAny(word, "{}") {
+		var err error
+		if wordSegments, err = parsePattern(word, false); err != nil {
+			return nil, false
+		}
+	}
+
+	segments := make([]segment, 0, len(t.segments)+len(wordSegments))
+	for _, g := range t.segments {
+		if g.kind == wordSegment {
+			segments = append(segments, wordSegments...)
+		} else {
+			segments = append(segments, g)
+		}
+	}
+	if _, ok := expansionSize(segments); !ok {
+		return nil, false
+	}
+	return segments, true
+}
+
+func expandSegments(segments []segment, prefix []byte, emit func(string)) {
+	if len(segments) == 0 {
+		emit(string(prefix))
+		return
+	}
+	g := segments[0]
+	for i := 0; i < g.size(); i++ {
+		expandSegments(segments[1:], append(prefix, g.value(i)...), emit)
+	}
+}
+
+func parsePattern(pattern string, allowWord bool) ([]segment, error) {
+	var segments []segment
+	for len(pattern) > 0 {
+		open := strings.IndexAny(pattern, "{}")
+		if open < 0 {
+			segments = append(segments, segment{kind: literalSegment, literal: pattern})
+			break
+		}
+		if pattern[open] == '}' {
+			return nil, fmt.Errorf("unexpected '}' in pattern %q", pattern)
+		}
+		if open > 0 {
+			segments = append(segments, segment{kind: literalSegment, literal: pattern[:open]})
+		}
+		end := strings.IndexByte(pattern[open:], '}')
+		if end < 0 {
+			return nil, fmt.Errorf("unclosed '{' in pattern %q", pattern)
+		}
+		g, err := parsePlaceholder(pattern[open+1:open+end], allowWord)
+		if err != nil {
+			return nil, err
+		}
+		segments = append(segments, g)
+		pattern = pattern[open+end+1:]
+	}
+	return segments, nil
+}
+
+func parsePlaceholder(body string, allowWord bool) (segment, error) {
+	if strings.Contains(body, "{") {
+		return segment{}, fmt.Errorf("nested '{' in placeholder {%s}", body)
+	}
+	if body == "word" {
+		if !allowWord {
+			return segment{}, fmt.Errorf("{word} can only be used in the scan template")
+		}
+		return segment{kind: wordSegment}, nil
+	}
+	if values, ok := namedSets[body]; ok {
+		return segment{kind: valuesSegment, values: values}, nil
+	}
+	if strings.Contains(body, ",") {
+		return segment{kind: valuesSegment, values: strings.Split(body, ",")}, nil
+	}
+	if loStr, hiStr, ok := strings.Cut(body, "-"); ok {
+		lo, errLo := strconv.Atoi(loStr)
+		hi, errHi := strconv.Atoi(hiStr)
+		if errLo != nil || errHi != nil || lo < 0 || hi < lo {
+			return segment{}, fmt.Errorf("invalid range {%s}", body)
+		}
+		// Compared before adding 1, which would overflow for hi = MaxInt.
+		if hi-lo >= maxRangeSize {
+			return segment{}, fmt.Errorf("range {%s} exceeds %d values", body, maxRangeSize)
+		}
+		width := 0
+		if len(loStr) > 1 && loStr[0] == '0' {
+			width = len(loStr)
+		}
+		return segment{kind: rangeSegment, lo: lo, hi: hi, width: width}, nil
+	}
+	return segment{}, fmt.Errorf("unknown placeholder {%s}", body)
+}
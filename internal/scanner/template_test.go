@@ -0,0 +1,61 @@
+package scanner
+
+import "testing"
+
+func TestParseTemplateRejectsOversizedExpansion(t *testing.T) {
+	if _, err := ParseTemplate("{0-99999}{0-99999}{0-99999}{0-99999}{word}"); err == nil {
+		t.Fatal("ParseTemplate accepted a pattern expanding to 10^20 names per entry")
+	}
+	if _, err := ParseTemplate("{0-99}{0-9999}{word}"); err != nil {
+		t.Fatalf("ParseTemplate rejected a pattern at the limit: %v", err)
+	}
+}
+
+func TestParseTemplateRejectsOversizedRanges(t *testing.T) {
+	for _, pattern := range []string{
+		"{0-9223372036854775807}{word}",
+		"{1-9223372036854775807}{word}",
+		"{0-99999999999999999999}{word}",
+	} {
+		if _, err := ParseTemplate(pattern); err == nil {
+			t.Errorf("ParseTemplate(%q) accepted an oversized range", pattern)
+		}
+	}
+	template, err := ParseTemplate("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := template.Count("www{0-9223372036854775807}"); n != 0 {
+		t.Errorf("Count of an entry with an oversized range = %d, want 0", n)
+	}
+}
+
+func TestCountRejectsOversizedEntries(t *testing.T) {
+	template, err := ParseTemplate("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := template.Count("{0-99999}{0-99999}{0-99999}{0-99999}"); n != 0 {
+		t.Errorf("Count of an entry over the limit = %d, want 0", n)
+	}
+	if n := template.Count("{0-999}{0-999}"); n != maxExpansion {
+		t.Errorf("Count of an entry at the limit = %d, want %d", n, maxExpansion)
+	}
+
+	// The template's own placeholders count towards the limit of an entry.
+	template, err = ParseTemplate("{0-99}.{word}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := template.Count("api{0-99999}"); n != 0 {
+		t.Errorf("Count of an entry over the limit with the template = %d, want 0", n)
+	}
+	emitted := 0
+	template.Expand("api{0-99999}", func(string) { emitted++ })
+	if emitted != 0 {
+		t.Errorf("Expand emitted %d names for an entry over the limit, want 0", emitted)
+	}
+	if n := template.Count("api{0-9}"); n != 1000 {
+		t.Errorf("Count(api{0-9}) = %d, want 1000", n)
+	}
+}
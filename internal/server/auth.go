@@ -0,0 +1,358 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+const (
+	sessionCookie = "subsonic_session"
+	sessionTTL    = 24 * time.Hour
+)
+
+// publicPaths are reachable without logging in, so the UI can find out
+// whether it has to ask for a password and then do so.
+var publicPaths = map[string]bool{
+	"/api/session": true,
+	"/api/login":   true,
+	"/api/logout":  true,
+}
+
+// isPublic reports whether path is reachable without logging in: one of
+// publicPaths or a translation catalog.
+func isPublic(path string) bool {
+	return publicPaths[path] || path == "/api/i18n" || strings.HasPrefix(path, "/api/i18n/")
+}
+
+// tokenUser is the identity of API clients using a bearer token. Tokens
+// carry admin rights. Its name is one validUserName rejects, so no account
+// can share the token clients' scans.
+var tokenUser = identity{Name: ":token", Role: roleAdmin}
+
+// authenticator guards the websocket and the API. Browsers log in with a
+// user name and password and get a session cookie; API clients send a token
+// as "Authorization: Bearer <token>". With no accounts and no tokens
+// configured every request is allowed as anonymous, but the origin check
+// still applies.
+type authenticator struct {
+	users          *userStore
+	tokens         []string
+	allowedOrigins map[string]bool
+
+	mu       sync.Mutex
+	sessions map[string]session
+
+	logins *loginLimiter
+}
+
+const (
+	// loginRate and loginBurst limit the login attempts from one address.
+	loginRate  = rate.Limit(1)
+	loginBurst = 10
+	// loginIdle is how long the limiter of an address is kept after its
+	// last attempt. By then it has refilled anyway.
+	loginIdle = time.Minute
+)
+
+// loginLimiter slows down password guessing. Every remote address has a
+// limiter of its own, so one client cannot lock everybody else out.
+type loginLimiter struct {
+	mu        sync.Mutex
+	addresses map[string]*addressLimiter
+	swept     time.Time
+}
+
+type addressLimiter struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+func newLoginLimiter() *loginLimiter {
+	return &loginLimiter{addresses: make(map[string]*addressLimiter)}
+}
+
+// allow reports whether the login request r may go ahead.
+func (l *loginLimiter) allow(r *http.Request) bool {
+	addr, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		addr = r.RemoteAddr
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	if now.Sub(l.swept) > loginIdle {
+		for a, al := range l.addresses {
+			if now.Sub(al.lastSeen) > loginIdle {
+				delete(l.addresses, a)
+			}
+		}
+		l.swept = now
+	}
+	al, ok := l.addresses[addr]
+	if !ok {
+		al = &addressLimiter{limiter: rate.NewLimiter(loginRate, loginBurst)}
+		l.addresses[addr] = al
+	}
+	al.lastSeen = now
+	return al.limiter.AllowN(now, 1)
+}
+
+// session is a logged-in browser. Sessions of accounts only store the name
+// and look the user up on every request, so role changes and deleted users
+// take effect immediately.
+type session struct {
+	user    identity
+	account bool
+	expires time.Time
+}
+
+type identityKey struct{}
+
+// requestIdentity returns who the request acts for, as established by
+// authenticator.middleware.
+func requestIdentity(r *http.Request) identity {
+	if id, ok := r.Context().Value(identityKey{}).(identity); ok {
+		return id
+	}
+	return anonymous
+}
+
+func newAuthenticator(users *userStore, tokens, allowedOrigins []string) *authenticator {
+	a := &authenticator{
+		users:          users,
+		allowedOrigins: make(map[string]bool),
+		sessions:       make(map[string]session),
+		logins:         newLoginLimiter(),
+	}
+	for _, token := range tokens {
+		if token = strings.TrimSpace(token); token != "" {
+			a.tokens = append(a.tokens, token)
+		}
+	}
+	for _, origin := range allowedOrigins {
+		if origin = strings.TrimSpace(origin); origin != "" {
+			a.allowedOrigins[strings.ToLower(strings.TrimSuffix(origin, "/"))] = true
+		}
+	}
+	return a
+}
+
+// enabled reports whether requests have to be authenticated.
+func (a *authenticator) enabled() bool {
+	return len(a.tokens) > 0 || !a.users.empty()
+}
+
+// middleware rejects requests to the websocket and the API that come from
+// a foreign origin or are not authenticated, and attaches the identity of
+// authenticated ones. Static files stay public so the UI can load and show
+// its login form.
+func (a *authenticator) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		guarded := r.URL.Path == "/ws" || strings.HasPrefix(r.URL.Path, "/api/")
+		if guarded && !a.checkOrigin(r) {
+			http.Error(w, "Origin not allowed", http.StatusForbidden)
+			return
+		}
+		user, ok := a.identify(r)
+		if guarded && !isPublic(r.URL.Path) && !ok {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if ok {
+			r = r.WithContext(context.WithValue(r.Context(), identityKey{}, user))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// adminOnly lets only admins through to next.
+func adminOnly(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !requestIdentity(r).isAdmin() {
+			http.Error(w, "Admin role required", http.StatusForbidden)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// checkOrigin accepts requests from the server's own origin and from the
+// configured allowed origins. Requests without an Origin header come from
+// programs rather than web pages, since browsers always send one on
+// cross-origin and websocket requests, and are accepted as well.
+func (a *authenticator) checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	if a.allowedOrigins[strings.ToLower(origin)] {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(u.Host, r.Host)
+}
+
+// identify returns who r acts for, or false if it is not authenticated.
+func (a *authenticator) identify(r *http.Request) (identity, bool) {
+	if !a.enabled() {
+		return anonymous, true
+	}
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		return tokenUser, a.validToken(token)
+	}
+	if cookie, err := r.Cookie(sessionCookie); err == nil {
+		return a.sessionUser(cookie.Value)
+	}
+	return identity{}, false
+}
+
+func (a *authenticator) validToken(token string) bool {
+	valid := false
+	for _, t := range a.tokens {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(t)) == 1 {
+			valid = true
+		}
+	}
+	return valid
+}
+
+// login checks the credentials typed into the login form. A token is
+// accepted as password with an empty user name.
+func (a *authenticator) login(name, password string) (session, error) {
+	if name == "" && a.validToken(password) {
+		return session{user: tokenUser}, nil
+	}
+	user, err := a.users.authenticate(name, password)
+	if err != nil {
+		return session{}, err
+	}
+	return session{user: user, account: true}, nil
+}
+
+func (a *authenticator) sessionUser(id string) (identity, bool) {
+	a.mu.Lock()
+	s, ok := a.sessions[id]
+	if ok && time.Now().After(s.expires) {
+		delete(a.sessions, id)
+		ok = false
+	}
+	a.mu.Unlock()
+	if !ok {
+		return identity{}, false
+	}
+	if s.account {
+		return a.users.lookup(s.user.Name)
+	}
+	return s.user, true
+}
+
+func (a *authenticator) newSession(s session) (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	id := hex.EncodeToString(b)
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	now := time.Now()
+	for sid, old := range a.sessions {
+		if now.After(old.expires) {
+			delete(a.sessions, sid)
+		}
+	}
+	s.expires = now.Add(sessionTTL)
+	a.sessions[id] = s
+	return id, nil
+}
+
+func (a *authenticator) endSession(id string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	delete(a.sessions, id)
+}
+
+// registerAuthAPI adds the login endpoints used by the UI to mux.
+func registerAuthAPI(mux *http.ServeMux, a *authenticator) {
+	mux.HandleFunc("GET /api/session", func(w http.ResponseWriter, r *http.Request) {
+		user, ok := a.identify(r)
+		response := map[string]interface{}{
+			"auth_required": a.enabled(),
+			"authenticated": ok,
+		}
+		if ok {
+			response["user"] = user
+		}
+		writeJSON(w, http.StatusOK, response)
+	})
+
+	mux.HandleFunc("POST /api/login", func(w http.ResponseWriter, r *http.Request) {
+		if !a.enabled() {
+			writeJSON(w, http.StatusOK, map[string]interface{}{"authenticated": true, "user": anonymous})
+			return
+		}
+		if !a.logins.allow(r) {
+			http.Error(w, "Too many login attempts", http.StatusTooManyRequests)
+			return
+		}
+		var body struct {
+			Username string `json:"username"`
+			Password string `json:"password"`
+		}
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&body); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		s, err := a.login(body.Username, body.Password)
+		if err != nil {
+			http.Error(w, "Invalid user name or password", http.StatusUnauthorized)
+			return
+		}
+		id, err := a.newSession(s)
+		if err != nil {
+			http.Error(w, "Failed to create session", http.StatusInternalServerError)
+			return
+		}
+		http.SetCookie(w, &http.Cookie{
+			Name:     sessionCookie,
+			Value:    id,
+			Path:     "/",
+			MaxAge:   int(sessionTTL.Seconds()),
+			HttpOnly: true,
+			Secure:   r.TLS != nil,
+			SameSite: http.SameSiteStrictMode,
+		})
+		writeJSON(w, http.StatusOK, map[string]interface{}{"authenticated": true, "user": s.user})
+	})
+
+	mux.HandleFunc("POST /api/logout", func(w http.ResponseWriter, r *http.Request) {
+		if cookie, err := r.Cookie(sessionCookie); err == nil {
+			a.endSession(cookie.Value)
+		}
+		http.SetCookie(w, &http.Cookie{
+			Name:     sessionCookie,
+			Value:    "",
+			Path:     "/",
+			MaxAge:   -1,
+			HttpOnly: true,
+			Secure:   r.TLS != nil,
+			SameSite: http.SameSiteStrictMode,
+		})
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
@@ -4,9 +4,11 @@ import (
 	"encoding/json"
 	"log"
 	"net/http"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
+	"github.com/vmihailenco/msgpack/v5"
 )
 
 const (
@@ -19,23 +21,59 @@ const (
 	// Send pings to peer with this period. Must be less than pongWait.
 	pingPeriod = (pongWait * 9) / 10
 
-	// Maximum message size allowed from peer.
-	maxMessageSize = 2048
-)
+	// Maximum message size allowed from peer. Large enough for a start_scan
+	// message carrying an inline wordlist of maxInlineBytes, which holds
+	// maxInlineWords words of the greatest length.
+	maxMessageSize = 4 << 20
 
-var upgrader = websocket.Upgrader{
-	ReadBufferSize:  1024,
-	WriteBufferSize: 1024,
-	CheckOrigin: func(r *http.Request) bool {
-		return true // Allow all connections
-	},
-}
+	// Messages shorter than this are not compressed, which would cost more
+	// than it saves.
+	minCompressedSize = 512
+)
 
 // Client is a middleman between the websocket connection and the hub.
+// Clients following a scan's event stream have no connection, see
+// serveEvents.
 type Client struct {
 	hub  *Hub
 	conn *websocket.Conn
-	send chan []byte
+	out  *outbox
+	// done is closed once the last message has been written and the
+	// connection closed.
+	done chan struct{}
+	// user is who the connection was authenticated as.
+	user identity
+	// subscribed holds the IDs of the scans the client follows besides
+	// those of its own user. It is only used by Hub.Run.
+	subscribed map[string]bool
+	// protocolVersion is the version agreed on in the handshake, zero
+	// before. It is only used by readPump.
+	protocolVersion int
+	// seq numbers the messages written. It is only used by writePump.
+	seq int64
+	// lang is the catalog the client's texts are rendered with, picked
+	// from Accept-Language and then by the hello message.
+	lang atomic.Pointer[catalog]
+	// scanID, if set, restricts the client to the events of that scan.
+	scanID string
+	// binaryResults is set once the client asked for scan_results in
+	// MessagePack.
+	binaryResults atomic.Bool
+}
+
+func newClient(hub *Hub, conn *websocket.Conn, user identity, lang *catalog) *Client {
+	c := &Client{hub: hub, conn: conn, out: newOutbox(), done: make(chan struct{}), user: user, subscribed: make(map[string]bool)}
+	c.lang.Store(lang)
+	return c
+}
+
+// follows reports whether the client gets the events of a scan: those of
+// its user's scans and of the scans it subscribed to.
+func (c *Client) follows(owner, scanID string) bool {
+	if c.scanID != "" {
+		return scanID == c.scanID
+	}
+	return c.user.Name == owner || c.subscribed[scanID]
 }
 
 // readPump pumps messages from the websocket connection to the hub.
@@ -58,65 +96,174 @@ func (c *Client) readPump() {
 
 		var msg Message
 		if err := json.Unmarshal(message, &msg); err != nil {
-			log.Printf("error unmarshaling message: %v", err)
-			break
+			c.hub.sendError(c, "", newScanError(errInvalidMessage, "error.invalid_message", textParams{"detail": err.Error()}))
+			continue
+		}
+
+		if msg.Type != msgClientHello && c.protocolVersion == 0 {
+			c.hub.sendError(c, msg.ID, newScanError(errHandshakeRequired, "error.handshake_required", nil))
+			continue
 		}
 
 		switch msg.Type {
-		case "start_scan":
+		case msgClientHello:
+			var payload ClientHelloPayload
+			if err := json.Unmarshal(msg.Payload, &payload); err != nil {
+				c.hub.sendError(c, msg.ID, newScanError(errInvalidPayload, "error.invalid_hello", textParams{"detail": err.Error()}))
+				break
+			}
+			if payload.ProtocolVersion < MinProtocolVersion || payload.ProtocolVersion > ProtocolVersion {
+				c.hub.sendError(c, msg.ID, newScanError(errUnsupportedVersion, "error.unsupported_version", textParams{
+					"version": payload.ProtocolVersion, "min": MinProtocolVersion, "max": ProtocolVersion,
+				}))
+				break
+			}
+			c.protocolVersion = payload.ProtocolVersion
+			if payload.Language != "" {
+				c.lang.Store(catalogFor(payload.Language))
+			}
+			resultEncoding := encodingJSON
+			if payload.ResultEncoding == encodingMsgpack {
+				resultEncoding = encodingMsgpack
+				c.binaryResults.Store(true)
+			}
+			if payload.Client != "" {
+				log.Printf("Client %q of %q connected with protocol version %d", payload.Client, c.user.Name, payload.ProtocolVersion)
+			}
+			ack := newMessage(msgHelloAck, "", HelloAckPayload{
+				ProtocolVersion: c.protocolVersion,
+				Language:        c.lang.Load().lang,
+				ResultEncoding:  resultEncoding,
+			})
+			ack.ID = msg.ID
+			c.out.pushMessage(ack)
+		case msgStartScan:
 			var payload StartScanPayload
 			if err := json.Unmarshal(msg.Payload, &payload); err != nil {
-				log.Printf("error unmarshaling payload: %v", err)
+				c.hub.sendError(c, msg.ID, newScanError(errInvalidPayload, "error.invalid_scan_payload", textParams{"detail": err.Error()}))
+				break
+			}
+			go c.hub.startScan(c, msg.ID, payload)
+		case msgSubscribeScan:
+			var payload SubscribeScanPayload
+			if err := json.Unmarshal(msg.Payload, &payload); err != nil {
+				c.hub.sendError(c, msg.ID, newScanError(errInvalidPayload, "error.invalid_subscribe_payload", textParams{"detail": err.Error()}))
 				break
 			}
-			go c.hub.runScan(payload)
+			go c.hub.subscribe(c, msg.ID, payload)
+		default:
+			c.hub.sendError(c, msg.ID, newScanError(errUnknownMessage, "error.unknown_message_type", textParams{"type": msg.Type}))
 		}
 	}
 }
 
-// writePump pumps messages from the hub to the websocket connection.
+// writePump pumps messages from the client's outbox to the websocket
+// connection. Whatever piled up while a write was in progress goes out in
+// one go, with results coalesced into as few messages as possible.
 func (c *Client) writePump() {
 	ticker := time.NewTicker(pingPeriod)
 	defer func() {
 		ticker.Stop()
 		c.conn.Close()
+		close(c.done)
 	}()
 	for {
 		select {
-		case message, ok := <-c.send:
-			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
-			if !ok {
-				// The hub closed the channel.
-				c.conn.WriteMessage(websocket.CloseMessage, []byte{})
-				return
-			}
-
-			w, err := c.conn.NextWriter(websocket.TextMessage)
-			if err != nil {
-				return
+		case <-c.out.ready:
+			messages, closed := c.pending()
+			for _, message := range messages {
+				if err := c.writeMessage(message); err != nil {
+					return
+				}
 			}
-			w.Write(message)
-
-			if err := w.Close(); err != nil {
+			if closed {
+				c.write(websocket.CloseMessage, []byte{})
 				return
 			}
 		case <-ticker.C:
-			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
-			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+			if err := c.write(websocket.PingMessage, nil); err != nil {
 				return
 			}
 		}
 	}
 }
 
-// serveWs handles websocket requests from the peer.
-func serveWs(hub *Hub, w http.ResponseWriter, r *http.Request) {
+// pending removes everything queued for the client and renders it into the
+// messages to write, followed by messages_dropped if results were lost.
+// closed reports whether the client is to be disconnected after them.
+func (c *Client) pending() (messages []Message, closed bool) {
+	entries, closed := c.out.take()
+	dropped := 0
+	for _, e := range entries {
+		rendered, n := e.render(c.hub.scans)
+		messages = append(messages, rendered...)
+		dropped += n
+	}
+	if dropped > 0 {
+		log.Printf("Client of %q fell behind, %d messages dropped", c.user.Name, dropped)
+		messages = append(messages, newMessage(msgMessagesDropped, "", MessagesDroppedPayload{Dropped: dropped}))
+	}
+	return messages, closed
+}
+
+// encode numbers message and encodes it as a websocket message of the
+// returned type: JSON text with the texts in the client's language, or
+// MessagePack for results if the client asked for it.
+func (c *Client) encode(message Message) (int, []byte, error) {
+	c.seq++
+	message.Seq = c.seq
+	if message.results != nil {
+		if c.binaryResults.Load() {
+			data, err := msgpack.Marshal(newBinaryResults(message))
+			return websocket.BinaryMessage, data, err
+		}
+		message.Payload, _ = json.Marshal(message.results)
+	}
+	if lang := c.lang.Load(); message.localizer != nil && lang.lang != defaultLanguage {
+		message.Payload, _ = json.Marshal(message.localizer.localize(lang))
+	}
+	data, err := json.Marshal(message)
+	return websocket.TextMessage, data, err
+}
+
+// writeMessage writes message to the websocket connection, compressed if
+// the client supports it and the message is large enough.
+func (c *Client) writeMessage(message Message) error {
+	messageType, data, err := c.encode(message)
+	if err != nil {
+		return err
+	}
+	c.conn.EnableWriteCompression(len(data) >= minCompressedSize)
+	return c.write(messageType, data)
+}
+
+func (c *Client) write(messageType int, data []byte) error {
+	c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+	return c.conn.WriteMessage(messageType, data)
+}
+
+// serveWs handles websocket requests from the peer. Only pages served by
+// this server or an allowed origin may connect.
+func serveWs(hub *Hub, auth *authenticator, w http.ResponseWriter, r *http.Request) {
+	upgrader := websocket.Upgrader{
+		ReadBufferSize:    1024,
+		WriteBufferSize:   1024,
+		CheckOrigin:       auth.checkOrigin,
+		EnableCompression: true,
+	}
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		log.Println(err)
 		return
 	}
-	client := &Client{hub: hub, conn: conn, send: make(chan []byte, 256)}
+	client := newClient(hub, conn, requestIdentity(r), catalogForRequest(r))
+	client.out.pushMessage(newMessage(msgHello, "", HelloPayload{
+		Server:             "subsonic",
+		ProtocolVersion:    ProtocolVersion,
+		MinProtocolVersion: MinProtocolVersion,
+		User:               client.user,
+		ResultEncodings:    []string{encodingJSON, encodingMsgpack},
+	}))
 	client.hub.register <- client
 
 	go client.writePump()
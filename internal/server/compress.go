@@ -0,0 +1,104 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/fs"
+	"os"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// wordlistExts are the file name suffixes recognized as wordlists, longest
+// first. Compressed lists are decompressed on the fly when read.
+var wordlistExts = []string{".txt.zst", ".txt.gz", ".txt"}
+
+// storedUploadExt is the suffix new uploads are stored with.
+const storedUploadExt = ".txt.zst"
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// splitWordlistName returns the wordlist ID for a file name, or false if the
+// file is not a wordlist.
+func splitWordlistName(name string) (string, bool) {
+	for _, ext := range wordlistExts {
+		if id, ok := strings.CutSuffix(name, ext); ok && id != "" {
+			return id, true
+		}
+	}
+	return "", false
+}
+
+// openWordlist opens the wordlist at path, decompressing it according to its
+// extension.
+func openWordlist(path string) (io.ReadCloser, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return decompressByName(path, file)
+}
+
+// openWordlistFS is openWordlist for a wordlist in fsys.
+func openWordlistFS(fsys fs.FS, name string) (io.ReadCloser, error) {
+	file, err := fsys.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return decompressByName(name, file)
+}
+
+// decompressByName wraps file in the decompressor its name calls for. The
+// returned reader closes file.
+func decompressByName(name string, file io.ReadCloser) (io.ReadCloser, error) {
+	switch {
+	case strings.HasSuffix(name, ".gz"):
+		gz, err := gzip.NewReader(file)
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+		return readCloser{gz, func() error { gz.Close(); return file.Close() }}, nil
+	case strings.HasSuffix(name, ".zst"):
+		zr, err := zstd.NewReader(file)
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+		return readCloser{zr, func() error { zr.Close(); return file.Close() }}, nil
+	}
+	return file, nil
+}
+
+// decompressReader sniffs r for gzip or zstd content and returns a reader of
+// the decompressed data, or of r unchanged if it is not compressed.
+func decompressReader(r io.Reader) (io.ReadCloser, error) {
+	br := bufio.NewReader(r)
+	magic, _ := br.Peek(len(zstdMagic))
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic):
+		return gzip.NewReader(br)
+	case bytes.HasPrefix(magic, zstdMagic):
+		zr, err := zstd.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		return readCloser{zr, func() error { zr.Close(); return nil }}, nil
+	}
+	return io.NopCloser(br), nil
+}
+
+type readCloser struct {
+	io.Reader
+	close func() error
+}
+
+func (rc readCloser) Close() error {
+	return rc.close()
+}
@@ -0,0 +1,125 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// serveEvents streams the events of one scan as Server-Sent Events, for
+// dashboards and scripts that cannot use the websocket. Each event is named
+// after the message type and its data is the message as sent on /ws:
+// scan_subscribed first, then the results numbered above after_seq and the
+// status as the scan goes on. scan_results events carry their ResultSeq as
+// the event ID, so an EventSource that reconnects with Last-Event-ID
+// resumes where it left off. The stream ends after the scan's final status;
+// a reconnect to a finished scan with nothing new gets 204 No Content,
+// which tells EventSource to stop. Texts are rendered in the language of
+// the lang parameter or else Accept-Language.
+func serveEvents(hub *Hub, w http.ResponseWriter, r *http.Request) {
+	user := requestIdentity(r)
+	scan, _, ok := hub.scans.snapshot(r.PathValue("id"), user)
+	if !ok {
+		http.Error(w, "Scan not found", http.StatusNotFound)
+		return
+	}
+
+	afterSeq := 0
+	lastEventID := r.Header.Get("Last-Event-ID")
+	if v := r.URL.Query().Get("after_seq"); v != "" && lastEventID == "" {
+		lastEventID = v
+	}
+	if lastEventID != "" {
+		n, err := strconv.Atoi(lastEventID)
+		if err != nil || n < 0 {
+			http.Error(w, "Invalid after_seq", http.StatusBadRequest)
+			return
+		}
+		afterSeq = n
+	}
+	if r.Header.Get("Last-Event-ID") != "" && !scan.Running && afterSeq >= scan.Found {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	lang := catalogForRequest(r)
+	if v := r.URL.Query().Get("lang"); v != "" {
+		lang = catalogFor(v)
+	}
+	client := newClient(hub, nil, user, lang)
+	client.scanID = scan.ID
+	hub.register <- client
+	defer func() {
+		hub.unregister <- client
+		close(client.done)
+	}()
+	hub.subscribe(client, "", SubscribeScanPayload{ScanID: scan.ID, AfterSeq: afterSeq})
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	// Keeps nginx and similar proxies from buffering the stream.
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	rc := http.NewResponseController(w)
+	if err := rc.Flush(); err != nil {
+		log.Printf("error streaming events of scan %s: %v", scan.ID, err)
+		return
+	}
+
+	ticker := time.NewTicker(pingPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-client.out.ready:
+			messages, closed := client.pending()
+			for _, message := range messages {
+				if err := writeEvent(client, w, rc, message); err != nil {
+					return
+				}
+				if isFinalStatus(message) {
+					return
+				}
+			}
+			if closed {
+				return
+			}
+		case <-ticker.C:
+			// A comment, which keeps proxies from closing an idle stream.
+			rc.SetWriteDeadline(time.Now().Add(writeWait))
+			if _, err := fmt.Fprint(w, ": ping\n\n"); err != nil {
+				return
+			}
+			if err := rc.Flush(); err != nil {
+				return
+			}
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// writeEvent writes message as an event of the client's stream.
+func writeEvent(c *Client, w http.ResponseWriter, rc *http.ResponseController, message Message) error {
+	_, data, err := c.encode(message)
+	if err != nil {
+		return err
+	}
+	var event []byte
+	if message.Type == msgScanResults {
+		event = fmt.Appendf(event, "id: %d\n", message.ResultSeq)
+	}
+	event = fmt.Appendf(event, "event: %s\ndata: %s\n\n", message.Type, data)
+	rc.SetWriteDeadline(time.Now().Add(writeWait))
+	if _, err := w.Write(event); err != nil {
+		return err
+	}
+	return rc.Flush()
+}
+
+// isFinalStatus reports whether message is the last status of a scan.
+func isFinalStatus(message Message) bool {
+	status, ok := message.localizer.(ScanStatusPayload)
+	return message.Type == msgScanStatus && ok && status.Status == scanStateDone
+}
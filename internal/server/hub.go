@@ -1,56 +1,233 @@
 package server
 
 import (
-	"bufio"
+	"context"
 	"encoding/json"
-	"fmt"
 	"log"
-	"os"
-	"path/filepath"
+	"math"
 	"subsonic/internal/scanner"
 	"sync"
 	"time"
 )
 
-// Hub maintains the set of active clients and broadcasts messages to the
-// clients.
+// Hub maintains the set of active clients and delivers scan messages to the
+// clients of the user who started the scan.
 type Hub struct {
-	clients      map[*Client]bool
-	broadcast    chan []byte
-	register     chan *Client
-	unregister   chan *Client
-	debugNetwork bool
+	clients       map[*Client]bool
+	publish       chan scanEvent
+	register      chan *Client
+	unregister    chan *Client
+	subscriptions chan subscription
+	closeAll      chan closeRequest
+	wordlists     *wordlistRegistry
+	learned       *learnedWordlist
+	scans         *scanStore
+	debugNetwork  bool
+
+	// ctx is cancelled to stop all running scans on shutdown. running
+	// counts the scans still in runScan; once stopping is set no more are
+	// started.
+	ctx      context.Context
+	cancel   context.CancelFunc
+	mu       sync.Mutex
+	stopping bool
+	running  sync.WaitGroup
+	// closed is set by Run once every client has been disconnected for
+	// shutdown; clients connecting later are turned away.
+	closed bool
+}
+
+// scanEvent is news about a scan for every client of the user who started
+// it and every client subscribed to it: either a scan_status message or the
+// results numbered from+1 to to.
+type scanEvent struct {
+	owner    string
+	scanID   string
+	status   *Message
+	from, to int
 }
 
-func NewHub(debugNetwork bool) *Hub {
+// subscription is a subscribe_scan command.
+type subscription struct {
+	client    *Client
+	requestID string
+	SubscribeScanPayload
+}
+
+// resultBatchSize is the largest number of results sent in one
+// scan_results message.
+const resultBatchSize = 500
+
+// publishBuffer is how many scan events may wait for Run, which only
+// queues them in the clients' outboxes, before a scan has to wait.
+const publishBuffer = 1024
+
+// closeRequest asks Run to send message to every client and disconnect
+// them. The clients are sent back on closed.
+type closeRequest struct {
+	message Message
+	closed  chan []*Client
+}
+
+func NewHub(debugNetwork bool, wordlists *wordlistRegistry, learned *learnedWordlist, scans *scanStore) *Hub {
+	ctx, cancel := context.WithCancel(context.Background())
 	return &Hub{
-		broadcast:    make(chan []byte),
-		register:     make(chan *Client),
-		unregister:   make(chan *Client),
-		clients:      make(map[*Client]bool),
-		debugNetwork: debugNetwork,
+		publish:       make(chan scanEvent, publishBuffer),
+		register:      make(chan *Client),
+		unregister:    make(chan *Client),
+		subscriptions: make(chan subscription),
+		closeAll:      make(chan closeRequest),
+		clients:       make(map[*Client]bool),
+		wordlists:     wordlists,
+		learned:       learned,
+		scans:         scans,
+		debugNetwork:  debugNetwork,
+		ctx:           ctx,
+		cancel:        cancel,
+	}
+}
+
+// Shutdown stops all running scans and waits for them to save what they
+// found and publish their final status, then tells every client that the
+// server is going away and disconnects it. It gives up waiting when ctx is
+// done.
+func (h *Hub) Shutdown(ctx context.Context) {
+	h.mu.Lock()
+	h.stopping = true
+	h.mu.Unlock()
+	h.cancel()
+
+	scansDone := make(chan struct{})
+	go func() {
+		h.running.Wait()
+		close(scansDone)
+	}()
+	select {
+	case <-scansDone:
+	case <-ctx.Done():
+		log.Println("Timed out waiting for scans to stop")
+	}
+
+	req := closeRequest{
+		message: newMessage(msgServerShutdown, "", ServerShutdownPayload{Key: "server.shutdown", Message: render("server.shutdown", nil)}),
+		closed:  make(chan []*Client, 1),
+	}
+	h.closeAll <- req
+	for _, client := range <-req.closed {
+		select {
+		case <-client.done:
+		case <-ctx.Done():
+			return
+		}
 	}
 }
 
-func (h *Hub) runScan(payload StartScanPayload) {
+// beginScan registers a scan as running, unless the hub is shutting down.
+func (h *Hub) beginScan() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.stopping {
+		return false
+	}
+	h.running.Add(1)
+	return true
+}
+
+// sendError reports a failed command to the client that sent it.
+func (h *Hub) sendError(c *Client, requestID string, scanErr *ScanError) {
+	log.Printf("scan error: %v", scanErr)
+	message := newMessage(msgScanError, "", scanErr)
+	message.ID = requestID
+	c.out.pushMessage(message)
+}
+
+// publishStatus sends a scan_status message about scan to its owner's
+// clients and to the clients subscribed to it. The latest status is kept
+// for clients that subscribe later.
+func (h *Hub) publishStatus(scan *scanRecord, payload ScanStatusPayload) {
+	message := newMessage(msgScanStatus, scan.ID, payload)
+	h.scans.setStatus(scan.ID, message.Payload)
+	h.publish <- scanEvent{owner: scan.Owner, scanID: scan.ID, status: &message}
+}
+
+// publishResults sends the scan's results numbered from+1 to to, which
+// must be in the scan store already, to the same clients.
+func (h *Hub) publishResults(scan *scanRecord, from, to int) {
+	h.publish <- scanEvent{owner: scan.Owner, scanID: scan.ID, from: from, to: to}
+}
+
+// subscribe queues a subscribe_scan command from c for Run.
+func (h *Hub) subscribe(c *Client, requestID string, payload SubscribeScanPayload) {
+	h.subscriptions <- subscription{client: c, requestID: requestID, SubscribeScanPayload: payload}
+}
+
+// startScan validates the scan request from c and runs it as a scan owned
+// by c's user. Problems found before the scan starts are reported to c as a
+// scan_error.
+func (h *Hub) startScan(c *Client, requestID string, payload StartScanPayload) {
+	err := h.runScan(c.user, payload, func(scan ScanStartedPayload) {
+		started := newMessage(msgScanStarted, scan.ScanID, scan)
+		started.ID = requestID
+		c.out.pushMessage(started)
+	})
+	if err != nil {
+		h.sendError(c, requestID, err)
+	}
+}
+
+// runScan validates the scan request and runs it as a scan owned by user,
+// publishing results and status to that user's clients. started is called
+// with the scan_started payload of the new scan before anything about it is
+// published. The error
+// returned, if any, is found before the scan starts.
+func (h *Hub) runScan(user identity, payload StartScanPayload, started func(ScanStartedPayload)) *ScanError {
+	if !h.beginScan() {
+		return newScanError(errShuttingDown, "error.shutting_down", nil)
+	}
+	defer h.running.Done()
+
 	startTime := time.Now()
-	wordlistChan := make(chan string, 1000)
 
-	// The key can now be "common_speak" or "temp/some-uuid.txt"
-	wordlistPath := filepath.Join("wordlists", payload.WordlistKey+".txt")
-	
-	// For temp files, the key already includes the .txt extension
-	if filepath.Ext(payload.WordlistKey) == ".txt" {
-		wordlistPath = filepath.Join("wordlists", payload.WordlistKey)
+	if scanErr := payload.validate(); scanErr != nil {
+		return scanErr
 	}
 
-	count, err := getWordlistLineCount(wordlistPath)
+	template, err := scanner.ParseTemplate(payload.Template)
 	if err != nil {
-		log.Printf("error counting wordlist %s: %v", wordlistPath, err)
-		return
+		return newScanError(errInvalidTemplate, "error.invalid_template", textParams{"detail": err.Error()})
+	}
+
+	source, err := newWordlistSource(h.wordlists, payload.WordlistKeys, payload.Wordlist, payload.Domain)
+	if err != nil {
+		return newScanError(errInvalidWordlist, "error.invalid_wordlist", textParams{"detail": err.Error()})
+	}
+	defer source.release(h.wordlists)
+	source.shard = payload.shard
+	if payload.Shuffle {
+		source.shuffle, source.seed = true, payload.ShuffleSeed
+		if source.seed == 0 {
+			// Kept below 2^53, so that JavaScript clients can show and
+			// reuse it exactly.
+			source.seed = time.Now().UnixNano()%(1<<53) + 1
+		}
+		log.Printf("Shuffling wordlist %s with seed %d", source, source.seed)
+	}
+	if payload.PrioritizeLearned {
+		source.priority = h.learned.words()
+	}
+
+	count, err := source.count(template)
+	if err != nil {
+		log.Printf("error counting wordlist %s: %v", source, err)
+		return newScanError(errWordlistUnavailable, "error.wordlist_unavailable", textParams{"wordlist": source.String()})
+	}
+	if count == 0 {
+		return newScanError(errInvalidWordlist, "error.wordlist_empty", textParams{"wordlist": source.String()})
+	}
+	if source.shard.active() {
+		log.Printf("Scanning shard %s of wordlist %s: %d names", source.shard, source, count)
 	}
 	totalTasks := count
-	go streamWordlist(wordlistPath, wordlistChan)
 
 	scn := scanner.NewScanner(h.debugNetwork)
 	if len(payload.DNSServers) > 0 {
@@ -60,16 +237,63 @@ func (h *Hub) runScan(payload StartScanPayload) {
 	resultsChan := make(chan *scanner.ScanResult)
 	statusChan := make(chan scanner.ScanStatus)
 
-	go scn.Start(payload.Domain, wordlistChan, totalTasks, resultsChan, statusChan, payload.Concurrency, payload.Adaptive, payload.MaxQPS, payload.EnableRetry)
+	opts := scanner.Options{
+		Concurrency:     payload.Concurrency,
+		Adaptive:        payload.Adaptive,
+		MaxQPS:          payload.MaxQPS,
+		EnableRetry:     payload.EnableRetry,
+		Template:        template,
+		RecursionDepth:  payload.RecursionDepth,
+		RecursionLabels: payload.RecursionLabels,
+
+		Permutations:     payload.Permutations,
+		PermutationWords: payload.PermutationWords,
+	}
+	if payload.RecursionDepth > 0 {
+		// Recursion reuses the main wordlist unless a dedicated one is given.
+		// Every shard recurses with all of it, since the names found differ
+		// from host to host.
+		recursionSource := source
+		recursionSource.shard = shardSpec{}
+		recursionSource.priority = nil
+		if payload.RecursionWordlistKey != "" {
+			recursionSource, err = registeredWordlistSource(h.wordlists, payload.RecursionWordlistKey)
+			if err != nil {
+				return newScanError(errInvalidWordlist, "error.invalid_recursion_wordlist", textParams{"detail": err.Error()})
+			}
+			defer recursionSource.release(h.wordlists)
+		}
+		recursionCount, err := recursionSource.count(template)
+		if err != nil {
+			log.Printf("error counting recursion wordlist %s: %v", recursionSource, err)
+			return newScanError(errWordlistUnavailable, "error.recursion_wordlist_unavailable", textParams{"wordlist": recursionSource.String()})
+		}
+		opts.RecursionWordCount = recursionCount
+		opts.RecursionWordlist = func() <-chan string {
+			ch := make(chan string, 1000)
+			go recursionSource.stream(h.ctx, ch)
+			return ch
+		}
+	}
+
+	scan := h.scans.create(user, payload.Domain)
+	started(ScanStartedPayload{ScanID: scan.ID, Domain: scan.Domain, ShuffleSeed: source.seed})
+
+	wordlistChan := make(chan string, 1000)
+	go source.stream(h.ctx, wordlistChan)
+	go scn.Start(h.ctx, payload.Domain, wordlistChan, totalTasks, resultsChan, statusChan, opts)
 
 	var wg sync.WaitGroup
 	wg.Add(2)
 
+	// Names found, to learn from once the scan is over.
+	var found []string
+
 	go func() {
 		defer wg.Done()
 		const batchSize = 50
 		const batchTimeout = 100 * time.Millisecond
-		
+
 		batch := make([]*scanner.ScanResult, 0, batchSize)
 		ticker := time.NewTicker(batchTimeout)
 		defer ticker.Stop()
@@ -78,10 +302,8 @@ func (h *Hub) runScan(payload StartScanPayload) {
 			if len(batch) == 0 {
 				return
 			}
-			payloadBytes, _ := json.Marshal(batch)
-			msg := Message{Type: "scan_results", Payload: payloadBytes}
-			msgBytes, _ := json.Marshal(msg)
-			h.broadcast <- msgBytes
+			seq := h.scans.addResults(scan.ID, batch)
+			h.publishResults(scan, seq-len(batch), seq)
 			for _, r := range batch {
 				scanner.PutScanResult(r)
 			}
@@ -96,6 +318,7 @@ func (h *Hub) runScan(payload StartScanPayload) {
 					return
 				}
 				batch = append(batch, result)
+				found = append(found, result.Subdomain)
 				if len(batch) >= batchSize {
 					flush()
 				}
@@ -115,120 +338,152 @@ func (h *Hub) runScan(payload StartScanPayload) {
 				progress = float64(status.Scanned) / float64(status.Total)
 			}
 
-			message := ""
-			switch status.Phase {
-			case "main_scan":
-				message = fmt.Sprintf("扫描中... (%d/%d) | 失败: %d | 并发: %d", status.Scanned, status.Total, status.Failed, status.Concurrency)
-			case "retry_scan":
-				message = fmt.Sprintf("重试失败域名... (%d/%d) | 并发: %d", status.Scanned, status.TotalRetrying, status.Concurrency)
-			case "done":
+			if status.Phase == "done" {
 				continue // Final summary is handled outside this loop
 			}
 
-			payload := map[string]interface{}{
-				"status":         "scanning",
-				"progress":       progress,
-				"message":        message,
-				"phase":          status.Phase,
-				"total_retrying": status.TotalRetrying,
-				"scanned":        status.Scanned,
-				"total":          status.Total,
-				"failed":         status.Failed,
-				"totalRequests":  status.TotalRequests,
-				"totalRetries":   status.TotalRetries,
+			payload := ScanStatusPayload{
+				Status:        scanStateScanning,
+				Phase:         status.Phase,
+				Progress:      progress,
+				Depth:         status.Depth,
+				Scanned:       status.Scanned,
+				Total:         status.Total,
+				Failed:        status.Failed,
+				TotalRetrying: status.TotalRetrying,
+				Concurrency:   status.Concurrency,
+				TotalRequests: status.TotalRequests,
+				TotalRetries:  status.TotalRetries,
+				Key:           "status." + status.Phase,
+				Params: textParams{
+					"depth":          status.Depth,
+					"scanned":        status.Scanned,
+					"total":          status.Total,
+					"failed":         status.Failed,
+					"total_retrying": status.TotalRetrying,
+					"concurrency":    status.Concurrency,
+				},
 			}
-			payloadBytes, _ := json.Marshal(payload)
-			msg := Message{Type: "scan_status", Payload: payloadBytes}
-			msgBytes, _ := json.Marshal(msg)
-			h.broadcast <- msgBytes
+			payload.Message = render(payload.Key, payload.Params)
+			h.publishStatus(scan, payload)
 		}
 	}()
 
 	wg.Wait()
 	duration := time.Since(startTime)
+	interrupted := h.ctx.Err() != nil
+	// An interrupted scan queried fewer names than planned, which would
+	// hide a wildcard from the hit ratio check, so it is not learned from.
+	if !interrupted {
+		h.learned.record(payload.Domain, found, lastStatus.Queried)
+	}
 
 	failedRate := 0.0
 	if totalTasks > 0 {
 		failedRate = float64(lastStatus.Failed) / float64(totalTasks)
 	}
-	
-	summary := fmt.Sprintf(
-		"查询失败 %d 个 (%.2f%%)。共发送 %d 个请求 (重试 %d 次)，总耗时 %.2f 秒。",
-		lastStatus.Failed,
-		failedRate*100,
-		lastStatus.TotalRequests,
-		lastStatus.TotalRetries,
-		duration.Seconds(),
-	)
-
-	finalPayload := map[string]interface{}{
-		"status":        "done",
-		"progress":      1.0,
-		"message":       "扫描完成",
-		"summary":       summary,
-		"failed":        lastStatus.Failed,
-		"totalRequests": lastStatus.TotalRequests,
-		"totalRetries":  lastStatus.TotalRetries,
-		"duration":      duration.Seconds(),
-	}
-	finalPayloadBytes, _ := json.Marshal(finalPayload)
-	finalMsg := Message{Type: "scan_status", Payload: finalPayloadBytes}
-	finalMsgBytes, _ := json.Marshal(finalMsg)
-	h.broadcast <- finalMsgBytes
-}
 
-func getWordlistLineCount(path string) (int, error) {
-	file, err := os.Open(path)
-	if err != nil {
-		return 0, err
+	final := ScanStatusPayload{
+		Status:        scanStateDone,
+		Progress:      1.0,
+		Failed:        lastStatus.Failed,
+		TotalRequests: lastStatus.TotalRequests,
+		TotalRetries:  lastStatus.TotalRetries,
+		Duration:      duration.Seconds(),
+		Key:           "status.done",
+		SummaryKey:    "summary.done",
+		Params: textParams{
+			"failed":         lastStatus.Failed,
+			"failed_percent": math.Round(failedRate*10000) / 100,
+			"total_requests": lastStatus.TotalRequests,
+			"total_retries":  lastStatus.TotalRetries,
+			"duration":       math.Round(duration.Seconds()*100) / 100,
+		},
 	}
-	defer file.Close()
-
-	scanner := bufio.NewScanner(file)
-	count := 0
-	for scanner.Scan() {
-		count++
-	}
-	return count, scanner.Err()
-}
-
-func streamWordlist(path string, wordlistChan chan<- string) {
-	defer close(wordlistChan)
-	file, err := os.Open(path)
-	if err != nil {
-		log.Printf("error opening wordlist for streaming: %v", err)
-		return
-	}
-	defer file.Close()
-
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		wordlistChan <- scanner.Text()
-	}
-	if err := scanner.Err(); err != nil {
-		log.Printf("error reading wordlist: %v", err)
+	if interrupted {
+		final.Interrupted = true
+		final.Key = "status.interrupted"
+		final.SummaryKey = "summary.interrupted"
 	}
+	final.Message = render(final.Key, final.Params)
+	final.Summary = render(final.SummaryKey, final.Params)
+	finalStatus, _ := json.Marshal(final)
+	h.scans.finish(scan.ID, final.Summary, finalStatus, interrupted)
+	h.publishStatus(scan, final)
+	return nil
 }
 
 func (h *Hub) Run() {
 	for {
 		select {
 		case client := <-h.register:
+			if h.closed {
+				client.out.close()
+				continue
+			}
 			h.clients[client] = true
 		case client := <-h.unregister:
 			if _, ok := h.clients[client]; ok {
 				delete(h.clients, client)
-				close(client.send)
+				client.out.close()
 			}
-		case message := <-h.broadcast:
+		case e := <-h.publish:
 			for client := range h.clients {
-				select {
-				case client.send <- message:
-				default:
-					close(client.send)
-					delete(h.clients, client)
+				if !client.follows(e.owner, e.scanID) {
+					continue
+				}
+				if e.status != nil {
+					client.out.pushStatus(e.scanID, *e.status)
+				} else {
+					client.out.pushResults(e.scanID, e.from, e.to)
 				}
 			}
+		case sub := <-h.subscriptions:
+			if _, ok := h.clients[sub.client]; ok {
+				h.sendSnapshot(sub)
+			}
+		case req := <-h.closeAll:
+			closed := make([]*Client, 0, len(h.clients))
+			for client := range h.clients {
+				client.out.pushMessage(req.message)
+				client.out.close()
+				delete(h.clients, client)
+				closed = append(closed, client)
+			}
+			h.closed = true
+			req.closed <- closed
+		}
+	}
+}
+
+// sendSnapshot subscribes the client to the scan and queues the results it
+// has not seen yet and the latest status. Running in Run, it is ordered
+// with the scan's own events: results published before may arrive twice,
+// which clients recognize by their sequence numbers, but none go missing.
+func (h *Hub) sendSnapshot(sub subscription) {
+	c := sub.client
+	scan, status, ok := h.scans.snapshot(sub.ScanID, c.user)
+	if !ok {
+		h.sendError(c, sub.requestID, newScanError(errScanNotFound, "error.scan_not_found", textParams{"scan_id": sub.ScanID}))
+		return
+	}
+	c.subscribed[scan.ID] = true
+	subscribed := newMessage(msgScanSubscribed, scan.ID, ScanSubscribedPayload{
+		ScanID:    scan.ID,
+		Domain:    scan.Domain,
+		Running:   scan.Running,
+		ResultSeq: scan.Found,
+	})
+	subscribed.ID = sub.requestID
+	c.out.pushMessage(subscribed)
+	c.out.pushResults(scan.ID, max(0, sub.AfterSeq), scan.Found)
+	if status != nil {
+		// Decoded so that its texts are sent in the client's language.
+		var payload ScanStatusPayload
+		if err := json.Unmarshal(status, &payload); err != nil {
+			log.Printf("error decoding status of scan %s: %v", scan.ID, err)
+			return
 		}
+		c.out.pushStatus(scan.ID, newMessage(msgScanStatus, scan.ID, payload))
 	}
 }
@@ -0,0 +1,115 @@
+package server
+
+import (
+	"fmt"
+	"subsonic/internal/scanner"
+	"testing"
+)
+
+// addTestResults adds n results named h1.example.com and up to the scan.
+func addTestResults(scans *scanStore, id string, n int) {
+	results := make([]*scanner.ScanResult, n)
+	for i := range results {
+		results[i] = &scanner.ScanResult{Subdomain: fmt.Sprintf("h%d.example.com", i+1)}
+	}
+	scans.addResults(id, results)
+}
+
+func TestSubscribeResumesAfterSeq(t *testing.T) {
+	scans, err := newScanStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	owner := identity{Name: "alice"}
+	scan := scans.create(owner, "example.com")
+	addTestResults(scans, scan.ID, 30)
+	scans.setStatus(scan.ID, []byte(`{"phase":"wordlist_scan"}`))
+	hub := &Hub{scans: scans}
+
+	tests := []struct {
+		afterSeq int
+		want     []string
+	}{
+		{0, []string{"message " + msgScanSubscribed, "results " + scan.ID + " 0-30", "message " + msgScanStatus}},
+		{-5, []string{"message " + msgScanSubscribed, "results " + scan.ID + " 0-30", "message " + msgScanStatus}},
+		{12, []string{"message " + msgScanSubscribed, "results " + scan.ID + " 12-30", "message " + msgScanStatus}},
+		{30, []string{"message " + msgScanSubscribed, "message " + msgScanStatus}},
+		{45, []string{"message " + msgScanSubscribed, "message " + msgScanStatus}},
+	}
+	for _, tt := range tests {
+		client := newClient(hub, nil, owner, nil)
+		hub.sendSnapshot(subscription{client: client, requestID: "r1", SubscribeScanPayload: SubscribeScanPayload{ScanID: scan.ID, AfterSeq: tt.afterSeq}})
+		entries, _ := client.out.take()
+
+		var got []string
+		for _, e := range entries {
+			// The status payload is decoded and encoded again; compare its type.
+			if e.kind == outboxStatus {
+				got = append(got, "message "+e.message.Type)
+				continue
+			}
+			got = append(got, describeEntries([]outboxEntry{e})...)
+		}
+		if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+			t.Errorf("after_seq %d: queued %q, want %q", tt.afterSeq, got, tt.want)
+			continue
+		}
+		if entries[0].message.ID != "r1" {
+			t.Errorf("after_seq %d: scan_subscribed has ID %q, want r1", tt.afterSeq, entries[0].message.ID)
+		}
+		if len(entries) == 3 {
+			messages, _ := entries[1].render(scans)
+			first := max(0, tt.afterSeq) + 1
+			if want := fmt.Sprintf("h%d.example.com", first); messages[0].results[0].Subdomain != want {
+				t.Errorf("after_seq %d: results start at %s, want %s", tt.afterSeq, messages[0].results[0].Subdomain, want)
+			}
+		}
+		if !client.subscribed[scan.ID] {
+			t.Errorf("after_seq %d: client not subscribed", tt.afterSeq)
+		}
+	}
+}
+
+func TestSubscribeMergesResultsPublishedMeanwhile(t *testing.T) {
+	scans, err := newScanStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	owner := identity{Name: "alice"}
+	scan := scans.create(owner, "example.com")
+	addTestResults(scans, scan.ID, 20)
+	hub := &Hub{scans: scans}
+
+	// A batch published before the snapshot is taken overlaps it, one
+	// published after follows it; either way the client gets every result
+	// above after_seq in one range.
+	client := newClient(hub, nil, owner, nil)
+	client.out.pushResults(scan.ID, 15, 20)
+	hub.sendSnapshot(subscription{client: client, SubscribeScanPayload: SubscribeScanPayload{ScanID: scan.ID, AfterSeq: 8}})
+	client.out.pushResults(scan.ID, 20, 24)
+	entries, _ := client.out.take()
+	got := describeEntries(entries)
+	want := []string{"results " + scan.ID + " 8-24", "message " + msgScanSubscribed}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("queued %q, want %q", got, want)
+	}
+}
+
+func TestSubscribeHiddenScan(t *testing.T) {
+	scans, err := newScanStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	scan := scans.create(identity{Name: "alice"}, "example.com")
+	hub := &Hub{scans: scans}
+
+	client := newClient(hub, nil, identity{Name: "bob"}, nil)
+	hub.sendSnapshot(subscription{client: client, SubscribeScanPayload: SubscribeScanPayload{ScanID: scan.ID}})
+	entries, _ := client.out.take()
+	if got := describeEntries(entries); len(got) != 1 || got[0] != "message "+msgScanError {
+		t.Errorf("subscribing to another user's scan queued %q, want a scan_error", got)
+	}
+	if client.subscribed[scan.ID] {
+		t.Error("client subscribed to another user's scan")
+	}
+}
@@ -0,0 +1,167 @@
+package server
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// localeFiles holds the translation catalogs, one JSON object of texts per
+// language named after its language code. Texts refer to parameters as
+// {name}. The "_language" entry is the language's own name.
+//
+//go:embed locales/*.json
+var localeFiles embed.FS
+
+// defaultLanguage is used for clients that do not ask for a language, for
+// texts missing from a catalog, and for the logs.
+const defaultLanguage = "zh"
+
+// textParams are the values filled into a text's placeholders.
+type textParams map[string]interface{}
+
+// catalog is the translation of every text into one language.
+type catalog struct {
+	lang  string
+	texts map[string]string
+}
+
+var catalogs = loadCatalogs()
+
+func loadCatalogs() map[string]*catalog {
+	files, err := localeFiles.ReadDir("locales")
+	if err != nil {
+		panic(err)
+	}
+	catalogs := make(map[string]*catalog, len(files))
+	for _, f := range files {
+		data, err := localeFiles.ReadFile("locales/" + f.Name())
+		if err != nil {
+			panic(err)
+		}
+		c := &catalog{lang: strings.TrimSuffix(f.Name(), path.Ext(f.Name()))}
+		if err := json.Unmarshal(data, &c.texts); err != nil {
+			panic(fmt.Sprintf("locales/%s: %v", f.Name(), err))
+		}
+		catalogs[c.lang] = c
+	}
+	if catalogs[defaultLanguage] == nil {
+		panic("no catalog for the default language " + defaultLanguage)
+	}
+	return catalogs
+}
+
+// lookupCatalog finds the catalog for a language tag such as "en" or
+// "en-US".
+func lookupCatalog(lang string) (*catalog, bool) {
+	lang = strings.ToLower(strings.TrimSpace(lang))
+	if c, ok := catalogs[lang]; ok {
+		return c, true
+	}
+	if i := strings.IndexAny(lang, "-_"); i > 0 {
+		c, ok := catalogs[lang[:i]]
+		return c, ok
+	}
+	return nil, false
+}
+
+// catalogFor returns the catalog for lang, or that of the default language
+// if there is none.
+func catalogFor(lang string) *catalog {
+	if c, ok := lookupCatalog(lang); ok {
+		return c
+	}
+	return catalogs[defaultLanguage]
+}
+
+// catalogForRequest picks the catalog for the first language in the
+// request's Accept-Language header that has one.
+func catalogForRequest(r *http.Request) *catalog {
+	for _, part := range strings.Split(r.Header.Get("Accept-Language"), ",") {
+		tag, _, _ := strings.Cut(part, ";")
+		if c, ok := lookupCatalog(tag); ok {
+			return c
+		}
+	}
+	return catalogs[defaultLanguage]
+}
+
+// text renders the text for key with params filled in. Keys the catalog
+// lacks are taken from the default language, and unknown keys are
+// returned as they are.
+func (c *catalog) text(key string, params textParams) string {
+	text, ok := c.texts[key]
+	if !ok {
+		if text, ok = catalogs[defaultLanguage].texts[key]; !ok {
+			return key
+		}
+	}
+	if len(params) == 0 || !strings.Contains(text, "{") {
+		return text
+	}
+	replacements := make([]string, 0, 2*len(params))
+	for name, value := range params {
+		replacements = append(replacements, "{"+name+"}", formatParam(value))
+	}
+	return strings.NewReplacer(replacements...).Replace(text)
+}
+
+func formatParam(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// render renders key in the default language, for texts that are logged
+// or stored as well as sent.
+func render(key string, params textParams) string {
+	return catalogs[defaultLanguage].text(key, params)
+}
+
+// localizer is implemented by payloads carrying texts that are sent in the
+// language each client asked for.
+type localizer interface {
+	localize(c *catalog) interface{}
+}
+
+// languageInfo describes one of the available catalogs.
+type languageInfo struct {
+	Code string `json:"code"`
+	Name string `json:"name"`
+}
+
+// registerI18nAPI adds the endpoints serving the translation catalogs to
+// mux. They are public, so the login form can be translated too.
+func registerI18nAPI(mux *http.ServeMux) {
+	mux.HandleFunc("GET /api/i18n", func(w http.ResponseWriter, r *http.Request) {
+		languages := make([]languageInfo, 0, len(catalogs))
+		for code, c := range catalogs {
+			languages = append(languages, languageInfo{Code: code, Name: c.texts["_language"]})
+		}
+		sort.Slice(languages, func(i, j int) bool { return languages[i].Code < languages[j].Code })
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"default":   defaultLanguage,
+			"preferred": catalogForRequest(r).lang,
+			"languages": languages,
+		})
+	})
+
+	mux.HandleFunc("GET /api/i18n/{lang}", func(w http.ResponseWriter, r *http.Request) {
+		c, ok := lookupCatalog(r.PathValue("lang"))
+		if !ok {
+			http.Error(w, "Language not found", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, http.StatusOK, c.texts)
+	})
+}
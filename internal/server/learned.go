@@ -0,0 +1,226 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	learnedSubdir = "learned"
+	learnedID     = "learned"
+
+	// maxLearnedLabels bounds the labels remembered; the least productive
+	// are forgotten first.
+	maxLearnedLabels = 100000
+	// learnedMaxHitRatio is the share of queried names that may resolve
+	// before a scan is assumed to have hit a wildcard and is not learned
+	// from. Scans with fewer than learnedMinHits results are always used.
+	learnedMaxHitRatio = 0.5
+	learnedMinHits     = 100
+)
+
+// labelCount is how productive a label has been: the number of scans that
+// found a name containing it and the number of such names overall.
+type labelCount struct {
+	Scans int `json:"scans"`
+	Hits  int `json:"hits"`
+}
+
+// learnedState is the on-disk form of the learned wordlist's statistics.
+type learnedState struct {
+	Scans  int                    `json:"scans"`
+	Labels map[string]*labelCount `json:"labels"`
+}
+
+// learnedWordlist ranks the labels of every subdomain found by past scans
+// by how many scans found them. The ranking is written out as a wordlist
+// and registered under learnedID, so it can be scanned like a built-in.
+type learnedWordlist struct {
+	mu        sync.Mutex
+	dir       string
+	state     learnedState
+	ranked    []string
+	wordlists *wordlistRegistry
+}
+
+// newLearnedWordlist loads the statistics kept in the registry's directory
+// and registers the learned wordlist if it has any words yet.
+func newLearnedWordlist(wordlists *wordlistRegistry) (*learnedWordlist, error) {
+	l := &learnedWordlist{
+		dir:       filepath.Join(wordlists.dir, learnedSubdir),
+		state:     learnedState{Labels: make(map[string]*labelCount)},
+		wordlists: wordlists,
+	}
+	data, err := os.ReadFile(l.statePath())
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, &l.state); err != nil {
+			return nil, fmt.Errorf("reading %s: %w", l.statePath(), err)
+		}
+		if l.state.Labels == nil {
+			l.state.Labels = make(map[string]*labelCount)
+		}
+	}
+	l.rank()
+	if len(l.ranked) > 0 {
+		if err := l.writeList(); err != nil {
+			return nil, err
+		}
+	}
+	return l, nil
+}
+
+func (l *learnedWordlist) statePath() string {
+	return filepath.Join(l.dir, "labels.json")
+}
+
+func (l *learnedWordlist) listPath() string {
+	return filepath.Join(l.dir, learnedID+".txt")
+}
+
+// record learns from the names a scan of domain found after querying
+// queried names.
+func (l *learnedWordlist) record(domain string, found []string, queried int) {
+	if len(found) >= learnedMinHits && float64(len(found)) > learnedMaxHitRatio*float64(queried) {
+		log.Printf("Not learning from scan of %s: %d of %d names resolved, likely a wildcard", domain, len(found), queried)
+		return
+	}
+
+	hits := make(map[string]int)
+	suffix := "." + domain
+	for _, name := range found {
+		sub, ok := strings.CutSuffix(name, suffix)
+		if !ok || sub == "" {
+			continue
+		}
+		for _, label := range strings.Split(sub, ".") {
+			if label != "" && !strings.ContainsAny(label, "{}") {
+				hits[label]++
+			}
+		}
+	}
+	if len(hits) == 0 {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.state.Scans++
+	for label, n := range hits {
+		count, ok := l.state.Labels[label]
+		if !ok {
+			count = &labelCount{}
+			l.state.Labels[label] = count
+		}
+		count.Scans++
+		count.Hits += n
+	}
+	l.rank()
+	if err := l.save(); err != nil {
+		log.Printf("error saving learned wordlist: %v", err)
+	}
+}
+
+// rank sorts the labels by the number of scans that found them, then by
+// hits, and forgets those beyond maxLearnedLabels.
+func (l *learnedWordlist) rank() {
+	ranked := make([]string, 0, len(l.state.Labels))
+	for label := range l.state.Labels {
+		ranked = append(ranked, label)
+	}
+	sort.Slice(ranked, func(i, j int) bool {
+		a, b := l.state.Labels[ranked[i]], l.state.Labels[ranked[j]]
+		if a.Scans != b.Scans {
+			return a.Scans > b.Scans
+		}
+		if a.Hits != b.Hits {
+			return a.Hits > b.Hits
+		}
+		return ranked[i] < ranked[j]
+	})
+	if len(ranked) > maxLearnedLabels {
+		for _, label := range ranked[maxLearnedLabels:] {
+			delete(l.state.Labels, label)
+		}
+		ranked = ranked[:maxLearnedLabels]
+	}
+	l.ranked = ranked
+}
+
+// words returns the learned labels, most productive first. The slice must
+// not be modified.
+func (l *learnedWordlist) words() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.ranked
+}
+
+func (l *learnedWordlist) save() error {
+	data, err := json.Marshal(l.state)
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(l.statePath(), func(w *bufio.Writer) error {
+		_, err := w.Write(data)
+		return err
+	}); err != nil {
+		return err
+	}
+	return l.writeList()
+}
+
+// writeList writes the ranking as a wordlist and (re-)registers it.
+func (l *learnedWordlist) writeList() error {
+	err := writeFileAtomic(l.listPath(), func(w *bufio.Writer) error {
+		for _, label := range l.ranked {
+			if _, err := w.WriteString(label + "\n"); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return l.wordlists.putBuiltin(learnedID, l.listPath(), wordlistEntry{
+		LabelKey:       "wordlist.learned",
+		DescriptionKey: "wordlist.learned.description",
+		Params:         textParams{"scans": l.state.Scans},
+		Category:       "learned",
+	})
+}
+
+// writeFileAtomic writes path through a temporary file, so readers never see
+// it half-written.
+func writeFileAtomic(path string, write func(*bufio.Writer) error) error {
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	w := bufio.NewWriter(tmp)
+	err = write(w)
+	if err == nil {
+		err = w.Flush()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,186 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"hash/maphash"
+	"io"
+	"strings"
+	"subsonic/internal/scanner"
+
+	"golang.org/x/net/idna"
+)
+
+// maxEntryLength is the longest entry kept, the maximum length of a name.
+const maxEntryLength = scanner.MaxNameLength
+
+// maxDistinctEntries bounds the entries a list may have after duplicates are
+// removed. Uploads may decompress to several GiB, and the normalizer has to
+// remember every entry it kept to recognize duplicates.
+const maxDistinctEntries = 5000000
+
+var errTooManyEntries = fmt.Errorf("wordlist has more than %d distinct entries", maxDistinctEntries)
+
+// normalizeStats reports what normalizeWordlist did to a list.
+type normalizeStats struct {
+	Lines      int `json:"lines"`
+	Kept       int `json:"kept"`
+	Cleaned    int `json:"cleaned"`
+	Blank      int `json:"blank"`
+	Invalid    int `json:"invalid"`
+	Duplicates int `json:"duplicates"`
+}
+
+// wordNormalizer cleans up wordlist entries one at a time and remembers what
+// it has already emitted. Only hashes of the entries are kept, which holds
+// its memory to a few dozen bytes per entry however long they are; a
+// collision costs no more than one entry dropped as a duplicate.
+type wordNormalizer struct {
+	suffix   string
+	template *scanner.Template
+	seed     maphash.Seed
+	seen     map[uint64]struct{}
+	stats    normalizeStats
+	// err is set once the list has more than maxDistinctEntries entries.
+	err error
+}
+
+// newWordNormalizer returns a normalizer that strips domain, if not empty,
+// from entries that are full hostnames below it.
+func newWordNormalizer(domain string) *wordNormalizer {
+	n := &wordNormalizer{seed: maphash.MakeSeed(), seen: make(map[uint64]struct{})}
+	if domain != "" {
+		n.suffix = "." + strings.ToLower(strings.TrimSuffix(domain, "."))
+	}
+	n.template, _ = scanner.ParseTemplate("")
+	return n
+}
+
+// normalize returns the cleaned entry for line and whether it should be kept.
+// Entries are trimmed, lowercased, stripped of comments and the target
+// suffix, converted from IDN to punycode, validated as DNS labels and
+// de-duplicated. Entries with template placeholders are kept if they parse.
+func (n *wordNormalizer) normalize(line string) (string, bool) {
+	n.stats.Lines++
+
+	word := line
+	if i := strings.IndexByte(word, '#'); i >= 0 {
+		word = word[:i]
+	}
+	word = strings.ToLower(strings.TrimSpace(word))
+	word = strings.Trim(word, ".")
+	if n.suffix != "" {
+		word = strings.TrimSuffix(word, n.suffix)
+	}
+	if word == "" || n.suffix != "" && word == n.suffix[1:] {
+		n.stats.Blank++
+		return "", false
+	}
+
+	if !isASCII(word) {
+		ascii, err := idna.ToASCII(word)
+		if err != nil {
+			n.stats.Invalid++
+			return "", false
+		}
+		word = ascii
+	}
+
+	if !validEntry(word, n.template) {
+		n.stats.Invalid++
+		return "", false
+	}
+	hash := maphash.String(n.seed, word)
+	if _, ok := n.seen[hash]; ok {
+		n.stats.Duplicates++
+		return "", false
+	}
+	if len(n.seen) >= maxDistinctEntries {
+		n.err = errTooManyEntries
+		return "", false
+	}
+	n.seen[hash] = struct{}{}
+
+	if word != line {
+		n.stats.Cleaned++
+	}
+	n.stats.Kept++
+	return word, true
+}
+
+// normalizeWordlist copies src to dst one normalized entry per line. It
+// fails with errTooManyEntries once src has more than maxDistinctEntries.
+func normalizeWordlist(dst io.Writer, src io.Reader, domain string) (normalizeStats, error) {
+	n := newWordNormalizer(domain)
+	w := bufio.NewWriter(dst)
+	err := readLines(src, func(line string) error {
+		word, ok := n.normalize(line)
+		if n.err != nil {
+			return n.err
+		}
+		if ok {
+			if _, err := w.WriteString(word); err != nil {
+				return err
+			}
+			return w.WriteByte('\n')
+		}
+		return nil
+	})
+	if err != nil {
+		return n.stats, err
+	}
+	return n.stats, w.Flush()
+}
+
+// readLines calls fn for every line of r. Unlike bufio.Scanner it has no
+// limit on line length; overlong lines are passed on truncated to one byte
+// over maxEntryLength so they are still rejected as invalid.
+func readLines(r io.Reader, fn func(string) error) error {
+	br := bufio.NewReader(r)
+	var long []byte
+	for {
+		chunk, isPrefix, err := br.ReadLine()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if isPrefix || long != nil {
+			if len(long) <= maxEntryLength {
+				long = append(long, chunk...)
+			}
+			if isPrefix {
+				continue
+			}
+			chunk, long = long, nil
+		}
+		if len(chunk) > maxEntryLength+1 {
+			chunk = chunk[:maxEntryLength+1]
+		}
+		if err := fn(string(chunk)); err != nil {
+			return err
+		}
+	}
+}
+
+// validEntry reports whether word is a valid sequence of DNS labels, or a
+// template pattern that expands to at least one name.
+func validEntry(word string, template *scanner.Template) bool {
+	if len(word) > maxEntryLength {
+		return false
+	}
+	if strings.ContainsAny(word, "{}") {
+		return template.Count(word) > 0
+	}
+	return scanner.ValidName(word)
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= 0x80 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,81 @@
+package server
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestNormalize(t *testing.T) {
+	tests := []struct {
+		line string
+		want string
+		ok   bool
+	}{
+		{"www", "www", true},
+		{"  API  ", "api", true},
+		{"dev.internal", "dev.internal", true},
+		{"mail # primary MX", "mail", true},
+		{"# comment", "", false},
+		{"", "", false},
+		{"ftp.", "ftp", true},
+		{".vpn..", "vpn", true},
+		{"Shop.Example.com", "shop", true},
+		{"shop.example.com.", "", false}, // duplicate of the line above
+		{"example.com", "", false},
+		{"example.com.", "", false},
+		{"bücher", "xn--bcher-kva", true},
+		{"münchen.dev", "xn--mnchen-3ya.dev", true},
+		{"under_score", "under_score", true},
+		{"-bad", "", false},
+		{"bad-", "", false},
+		{"a..b", "", false},
+		{"sp ace", "", false},
+		{"semi;colon", "", false},
+		{strings.Repeat("a", 63), strings.Repeat("a", 63), true},
+		{strings.Repeat("b", 64), "", false},
+		{strings.Repeat("c.", 126) + "c", strings.Repeat("c.", 126) + "c", true},
+		{strings.Repeat("d.", 127) + "d", "", false},
+		{"web{0-9}", "web{0-9}", true},
+		{"{1-3}-node", "{1-3}-node", true},
+		{"web{0-9", "", false},
+		{"web{9-0}", "", false},
+		{"www", "", false},
+	}
+
+	n := newWordNormalizer("Example.com.")
+	for _, tt := range tests {
+		got, ok := n.normalize(tt.line)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("normalize(%q) = %q, %v, want %q, %v", tt.line, got, ok, tt.want, tt.ok)
+		}
+	}
+	if n.err != nil {
+		t.Errorf("normalizer error = %v, want nil", n.err)
+	}
+}
+
+func TestNormalizeWithoutDomain(t *testing.T) {
+	for _, line := range []string{"www.example.com", "WWW.example.com."} {
+		got, ok := newWordNormalizer("").normalize(line)
+		if got != "www.example.com" || !ok {
+			t.Errorf("normalize(%q) = %q, %v, want %q, true", line, got, ok, "www.example.com")
+		}
+	}
+}
+
+func TestNormalizeWordlist(t *testing.T) {
+	src := "www\r\nWWW\n\n# comment\napi.example.com\n-bad\nbücher\n" + strings.Repeat("x", 1000) + "\nmail"
+	var dst bytes.Buffer
+	stats, err := normalizeWordlist(&dst, strings.NewReader(src), "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "www\napi\nxn--bcher-kva\nmail\n"; dst.String() != want {
+		t.Errorf("normalizeWordlist wrote %q, want %q", dst.String(), want)
+	}
+	want := normalizeStats{Lines: 9, Kept: 4, Cleaned: 2, Blank: 2, Invalid: 2, Duplicates: 1}
+	if stats != want {
+		t.Errorf("normalizeWordlist stats = %+v, want %+v", stats, want)
+	}
+}
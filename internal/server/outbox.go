@@ -0,0 +1,152 @@
+package server
+
+import (
+	"log"
+	"sync"
+)
+
+// maxQueuedMessages bounds the messages waiting for a client that cannot be
+// coalesced, such as scan_started and scan_error. These answer the client's
+// own commands or set up the connection and are never dropped; a client
+// that lets this many pile up is disconnected instead.
+const maxQueuedMessages = 256
+
+type outboxKind int
+
+const (
+	// outboxMessage is a ready-made message.
+	outboxMessage outboxKind = iota
+	// outboxResults stands for the results of a scan numbered from+1 to
+	// to. They are read from the scan's result log when written, so any
+	// number of batches waiting for a slow client take no memory and go
+	// out together.
+	outboxResults
+	// outboxStatus is a scan_status message. Only the latest per scan is
+	// kept.
+	outboxStatus
+)
+
+type outboxEntry struct {
+	kind     outboxKind
+	scanID   string
+	message  Message
+	from, to int
+}
+
+// outbox holds the messages for one client until its writePump gets to
+// them. Pushing never blocks, so neither the hub nor the scans ever wait
+// for a slow client; instead its pending results and status updates are
+// coalesced.
+type outbox struct {
+	mu       sync.Mutex
+	entries  []outboxEntry
+	messages int
+	closed   bool
+	// ready is signalled whenever there is something to write.
+	ready chan struct{}
+}
+
+func newOutbox() *outbox {
+	return &outbox{ready: make(chan struct{}, 1)}
+}
+
+func (o *outbox) signal() {
+	select {
+	case o.ready <- struct{}{}:
+	default:
+	}
+}
+
+// pushMessage queues a message. If there are too many queued already, the
+// client is not reading its replies and the outbox is closed instead.
+func (o *outbox) pushMessage(message Message) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.closed {
+		return
+	}
+	if o.messages >= maxQueuedMessages {
+		log.Printf("Client has %d replies waiting, disconnecting it", o.messages)
+		o.closed = true
+		o.signal()
+		return
+	}
+	o.entries = append(o.entries, outboxEntry{kind: outboxMessage, message: message})
+	o.messages++
+	o.signal()
+}
+
+// pushResults queues the results of scanID numbered from+1 to to, merging
+// them into results of the same scan that are still waiting.
+func (o *outbox) pushResults(scanID string, from, to int) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.closed || from >= to {
+		return
+	}
+	for i := range o.entries {
+		e := &o.entries[i]
+		if e.kind == outboxResults && e.scanID == scanID {
+			e.from, e.to = min(e.from, from), max(e.to, to)
+			return
+		}
+	}
+	o.entries = append(o.entries, outboxEntry{kind: outboxResults, scanID: scanID, from: from, to: to})
+	o.signal()
+}
+
+// pushStatus queues a scan_status message, replacing one for the same scan
+// that is still waiting. It goes to the back of the queue, so a scan's
+// final status always follows its results.
+func (o *outbox) pushStatus(scanID string, message Message) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.closed {
+		return
+	}
+	for i, e := range o.entries {
+		if e.kind == outboxStatus && e.scanID == scanID {
+			o.entries = append(o.entries[:i], o.entries[i+1:]...)
+			break
+		}
+	}
+	o.entries = append(o.entries, outboxEntry{kind: outboxStatus, scanID: scanID, message: message})
+	o.signal()
+}
+
+// close makes the writePump disconnect the client once the queued messages
+// are written. Later pushes are ignored.
+func (o *outbox) close() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.closed = true
+	o.signal()
+}
+
+// take removes and returns everything queued and whether the outbox is
+// closed.
+func (o *outbox) take() ([]outboxEntry, bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	entries := o.entries
+	o.entries, o.messages = nil, 0
+	return entries, o.closed
+}
+
+// render turns an entry into the messages to write, reading results from
+// scans. Results the store no longer has are counted as dropped.
+func (e outboxEntry) render(scans *scanStore) (messages []Message, dropped int) {
+	if e.kind != outboxResults {
+		return []Message{e.message}, 0
+	}
+	results, from := scans.resultRange(e.scanID, e.from, e.to)
+	dropped = e.to - e.from - len(results)
+	seq := from
+	for len(results) > 0 {
+		batch := results[:min(resultBatchSize, len(results))]
+		results = results[len(batch):]
+		seq += len(batch)
+		messages = append(messages, Message{Type: msgScanResults, ScanID: e.scanID, ResultSeq: seq, results: batch})
+	}
+	return messages, dropped
+}
@@ -0,0 +1,157 @@
+package server
+
+import (
+	"fmt"
+	"testing"
+)
+
+// describeEntries summarizes queued entries for comparison.
+func describeEntries(entries []outboxEntry) []string {
+	out := make([]string, len(entries))
+	for i, e := range entries {
+		switch e.kind {
+		case outboxMessage:
+			out[i] = "message " + e.message.Type
+		case outboxResults:
+			out[i] = fmt.Sprintf("results %s %d-%d", e.scanID, e.from, e.to)
+		case outboxStatus:
+			out[i] = fmt.Sprintf("status %s %s", e.scanID, e.message.Payload)
+		}
+	}
+	return out
+}
+
+func TestOutboxCoalescing(t *testing.T) {
+	tests := []struct {
+		name string
+		push func(o *outbox)
+		want []string
+	}{
+		{
+			name: "results of a scan merge",
+			push: func(o *outbox) {
+				o.pushResults("a", 0, 10)
+				o.pushResults("a", 10, 25)
+				o.pushResults("a", 5, 12)
+			},
+			want: []string{"results a 0-25"},
+		},
+		{
+			name: "results of different scans stay apart",
+			push: func(o *outbox) {
+				o.pushResults("a", 0, 10)
+				o.pushResults("b", 0, 3)
+				o.pushResults("a", 10, 11)
+			},
+			want: []string{"results a 0-11", "results b 0-3"},
+		},
+		{
+			name: "empty ranges are ignored",
+			push: func(o *outbox) {
+				o.pushResults("a", 4, 4)
+				o.pushResults("a", 5, 2)
+			},
+			want: []string{},
+		},
+		{
+			name: "latest status replaces the one waiting and follows the results",
+			push: func(o *outbox) {
+				o.pushStatus("a", Message{Type: msgScanStatus, Payload: []byte(`1`)})
+				o.pushResults("a", 0, 10)
+				o.pushStatus("b", Message{Type: msgScanStatus, Payload: []byte(`1`)})
+				o.pushStatus("a", Message{Type: msgScanStatus, Payload: []byte(`2`)})
+			},
+			want: []string{"results a 0-10", "status b 1", "status a 2"},
+		},
+		{
+			name: "messages are kept in order",
+			push: func(o *outbox) {
+				o.pushMessage(Message{Type: msgScanStarted})
+				o.pushResults("a", 0, 1)
+				o.pushMessage(Message{Type: msgScanError})
+			},
+			want: []string{"message " + msgScanStarted, "results a 0-1", "message " + msgScanError},
+		},
+	}
+	for _, tt := range tests {
+		o := newOutbox()
+		tt.push(o)
+		entries, closed := o.take()
+		got := describeEntries(entries)
+		if closed || fmt.Sprint(got) != fmt.Sprint(tt.want) {
+			t.Errorf("%s: took %q, closed %v, want %q, open", tt.name, got, closed, tt.want)
+		}
+		if entries, _ := o.take(); len(entries) != 0 {
+			t.Errorf("%s: second take returned %q", tt.name, describeEntries(entries))
+		}
+	}
+}
+
+func TestOutboxOverflowDisconnects(t *testing.T) {
+	o := newOutbox()
+	for i := 0; i < maxQueuedMessages; i++ {
+		o.pushMessage(Message{Type: msgScanStarted, ID: fmt.Sprint(i)})
+	}
+	if _, closed := o.take(); closed {
+		t.Fatal("outbox closed at the limit")
+	}
+
+	for i := 0; i < maxQueuedMessages+1; i++ {
+		o.pushMessage(Message{Type: msgScanStarted, ID: fmt.Sprint(i)})
+	}
+	o.pushResults("a", 0, 10)
+	o.pushStatus("a", Message{Type: msgScanStatus})
+	entries, closed := o.take()
+	if !closed {
+		t.Error("outbox still open over the limit")
+	}
+	if len(entries) != maxQueuedMessages {
+		t.Fatalf("took %d entries after overflowing, want the %d queued before", len(entries), maxQueuedMessages)
+	}
+	for i, e := range entries {
+		if e.kind != outboxMessage || e.message.ID != fmt.Sprint(i) {
+			t.Fatalf("entry %d is %q, want message %d", i, describeEntries(entries[i:i+1]), i)
+		}
+	}
+}
+
+func TestOutboxRender(t *testing.T) {
+	scans, err := newScanStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	scan := scans.create(identity{Name: "alice"}, "example.com")
+	addTestResults(scans, scan.ID, 1200)
+
+	tests := []struct {
+		from, to    int
+		seqs        []int
+		first       string
+		wantDropped int
+	}{
+		{0, 1, []int{1}, "h1.example.com", 0},
+		{10, 20, []int{20}, "h11.example.com", 0},
+		{0, 1200, []int{500, 1000, 1200}, "h1.example.com", 0},
+		{1100, 1300, []int{1200}, "h1101.example.com", 100},
+		{1200, 1300, nil, "", 100},
+	}
+	for _, tt := range tests {
+		entry := outboxEntry{kind: outboxResults, scanID: scan.ID, from: tt.from, to: tt.to}
+		messages, dropped := entry.render(scans)
+		var seqs []int
+		for _, m := range messages {
+			seqs = append(seqs, m.ResultSeq)
+		}
+		if fmt.Sprint(seqs) != fmt.Sprint(tt.seqs) || dropped != tt.wantDropped {
+			t.Errorf("render(%d-%d) = seqs %v, dropped %d, want %v, %d", tt.from, tt.to, seqs, dropped, tt.seqs, tt.wantDropped)
+			continue
+		}
+		if len(messages) > 0 && messages[0].results[0].Subdomain != tt.first {
+			t.Errorf("render(%d-%d) starts at %s, want %s", tt.from, tt.to, messages[0].results[0].Subdomain, tt.first)
+		}
+	}
+
+	if messages, dropped := (outboxEntry{kind: outboxResults, scanID: "gone", from: 0, to: 5}).render(scans); len(messages) != 0 || dropped != 5 {
+		t.Errorf("render of an unknown scan = %d messages, dropped %d, want none, 5", len(messages), dropped)
+	}
+}
@@ -0,0 +1,211 @@
+package server
+
+import (
+	"encoding/json"
+	"subsonic/internal/scanner"
+)
+
+// ProtocolVersion is the version of the websocket protocol described by the
+// message types and payloads below. It changes whenever a change would break
+// existing clients; adding message types or payload fields does not.
+//
+// On connect the server sends a hello message. The client answers with its
+// own hello naming the protocol version it speaks, and may send commands
+// once the server has accepted it with hello_ack. Every message from the
+// server carries Seq, which counts up from 1 on each connection, and a
+// command's ID is echoed in the messages that answer it.
+const (
+	ProtocolVersion    = 1
+	MinProtocolVersion = 1
+)
+
+// Message types sent by clients.
+const (
+	msgClientHello   = "hello"
+	msgStartScan     = "start_scan"
+	msgSubscribeScan = "subscribe_scan"
+)
+
+// Message types sent by the server.
+const (
+	msgHello           = "hello"
+	msgHelloAck        = "hello_ack"
+	msgScanStarted     = "scan_started"
+	msgScanSubscribed  = "scan_subscribed"
+	msgScanResults     = "scan_results"
+	msgScanStatus      = "scan_status"
+	msgScanError       = "scan_error"
+	msgMessagesDropped = "messages_dropped"
+	msgServerShutdown  = "server_shutdown"
+)
+
+// Encodings of scan_results messages. Clients get JSON unless they ask for
+// MessagePack in their hello; the other messages are always JSON.
+const (
+	encodingJSON    = "json"
+	encodingMsgpack = "msgpack"
+)
+
+// newMessage builds a server message with payload encoded as JSON. Payloads
+// with texts are encoded again for clients that use another language than
+// the default, see localizer.
+func newMessage(msgType, scanID string, payload interface{}) Message {
+	payloadBytes, _ := json.Marshal(payload)
+	message := Message{Type: msgType, ScanID: scanID, Payload: payloadBytes}
+	if l, ok := payload.(localizer); ok {
+		message.localizer = l
+	}
+	return message
+}
+
+// HelloPayload is the payload of the hello message the server sends on
+// connect.
+type HelloPayload struct {
+	Server             string   `json:"server"`
+	ProtocolVersion    int      `json:"protocol_version"`
+	MinProtocolVersion int      `json:"min_protocol_version"`
+	User               identity `json:"user"`
+	ResultEncodings    []string `json:"result_encodings"`
+}
+
+// ClientHelloPayload is the payload of the hello message clients answer
+// with. Client optionally names the program, for the logs. Language picks
+// the catalog the texts sent to the client are rendered with, such as "en";
+// it defaults to that of the Accept-Language header of the connection.
+// ResultEncoding asks for scan_results in one of the server's
+// ResultEncodings; others are ignored.
+type ClientHelloPayload struct {
+	ProtocolVersion int    `json:"protocol_version"`
+	Client          string `json:"client,omitempty"`
+	Language        string `json:"language,omitempty"`
+	ResultEncoding  string `json:"result_encoding,omitempty"`
+}
+
+// HelloAckPayload is the payload of hello_ack, confirming the protocol
+// version, the language and the encoding of results the connection uses.
+type HelloAckPayload struct {
+	ProtocolVersion int    `json:"protocol_version"`
+	Language        string `json:"language"`
+	ResultEncoding  string `json:"result_encoding"`
+}
+
+// ScanStartedPayload is the payload of scan_started, the answer to a
+// start_scan command.
+type ScanStartedPayload struct {
+	ScanID string `json:"scan_id"`
+	Domain string `json:"domain"`
+	// ShuffleSeed is the seed the wordlist is shuffled with, the requested
+	// one or else the one the server picked, so the order can be repeated.
+	// It is only set for scans with Shuffle.
+	ShuffleSeed int64 `json:"shuffle_seed,omitempty"`
+}
+
+// ScanSubscribedPayload is the payload of scan_subscribed, the answer to a
+// subscribe_scan command. The results numbered above the command's AfterSeq
+// up to ResultSeq and the current status follow.
+type ScanSubscribedPayload struct {
+	ScanID    string `json:"scan_id"`
+	Domain    string `json:"domain"`
+	Running   bool   `json:"running"`
+	ResultSeq int    `json:"result_seq"`
+}
+
+// ScanResultsPayload is the payload of scan_results: newly found names,
+// numbered up to the message's ResultSeq.
+type ScanResultsPayload []scanner.ScanResult
+
+// binaryResults is a scan_results message for clients that asked for
+// MessagePack, sent as a binary websocket message. It has the fields of the
+// JSON message, but each result is an array of the name and its address.
+type binaryResults struct {
+	Type      string      `msgpack:"type"`
+	Seq       int64       `msgpack:"seq"`
+	ScanID    string      `msgpack:"scan_id"`
+	ResultSeq int         `msgpack:"result_seq"`
+	Payload   [][2]string `msgpack:"payload"`
+}
+
+func newBinaryResults(message Message) binaryResults {
+	b := binaryResults{
+		Type:      message.Type,
+		Seq:       message.Seq,
+		ScanID:    message.ScanID,
+		ResultSeq: message.ResultSeq,
+		Payload:   make([][2]string, len(message.results)),
+	}
+	for i, r := range message.results {
+		b.Payload[i] = [2]string{r.Subdomain, r.IPAddress}
+	}
+	return b
+}
+
+// Scan states reported in ScanStatusPayload.Status.
+const (
+	scanStateScanning = "scanning"
+	scanStateDone     = "done"
+)
+
+// ScanStatusPayload is the payload of scan_status. Status is "scanning"
+// until the final message, which has Status "done" and the totals. Phase
+// is the scanner phase ("main_scan", "retry_scan", "recursive_scan" or
+// "permutation_scan") and Scanned, Total and Failed count the names of the
+// current phase; in the final status Failed is the number of names that
+// could not be resolved at all.
+//
+// Key names the text describing the status in the translation catalogs and
+// Params are the values filled into it; SummaryKey is the text of the final
+// summary, which uses the same Params. Message and Summary are those texts
+// rendered in the client's language, for display; programs should use the
+// other fields.
+type ScanStatusPayload struct {
+	Status        string  `json:"status"`
+	Phase         string  `json:"phase,omitempty"`
+	Progress      float64 `json:"progress"`
+	Depth         int     `json:"depth,omitempty"`
+	Scanned       int     `json:"scanned,omitempty"`
+	Total         int     `json:"total,omitempty"`
+	Failed        int     `json:"failed"`
+	TotalRetrying int     `json:"total_retrying,omitempty"`
+	Concurrency   int     `json:"concurrency,omitempty"`
+	TotalRequests int     `json:"total_requests"`
+	TotalRetries  int     `json:"total_retries"`
+	// Duration is the scan's running time in seconds, set once it is done.
+	Duration float64 `json:"duration,omitempty"`
+	// Interrupted is set on the final status of a scan stopped early.
+	Interrupted bool `json:"interrupted,omitempty"`
+
+	Key        string     `json:"key,omitempty"`
+	SummaryKey string     `json:"summary_key,omitempty"`
+	Params     textParams `json:"params,omitempty"`
+	Message    string     `json:"message"`
+	Summary    string     `json:"summary,omitempty"`
+}
+
+func (p ScanStatusPayload) localize(c *catalog) interface{} {
+	if p.Key != "" {
+		p.Message = c.text(p.Key, p.Params)
+	}
+	if p.SummaryKey != "" {
+		p.Summary = c.text(p.SummaryKey, p.Params)
+	}
+	return p
+}
+
+// MessagesDroppedPayload is the payload of messages_dropped, telling a
+// client that could not keep up how many messages it missed. Clients
+// resubscribe to their scans to catch up.
+type MessagesDroppedPayload struct {
+	Dropped int `json:"dropped"`
+}
+
+// ServerShutdownPayload is the payload of server_shutdown, sent before the
+// server closes all connections.
+type ServerShutdownPayload struct {
+	Key     string `json:"key"`
+	Message string `json:"message"`
+}
+
+func (p ServerShutdownPayload) localize(c *catalog) interface{} {
+	p.Message = c.text(p.Key, nil)
+	return p
+}
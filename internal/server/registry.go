@@ -0,0 +1,647 @@
+package server
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"subsonic/internal/scanner"
+	"subsonic/internal/wordlists"
+	"sync"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	wordlistDir  = "wordlists"
+	uploadSubdir = "temp"
+)
+
+var (
+	errWordlistNotFound = errors.New("wordlist not found")
+	errWordlistBuiltin  = errors.New("built-in wordlists cannot be modified")
+	errWordlistInUse    = errors.New("wordlist is in use by a running scan")
+)
+
+// wordlistEntry is a wordlist the server is willing to scan with. Clients
+// only ever see the ID; the path never leaves the server.
+type wordlistEntry struct {
+	ID          string `json:"id"`
+	Label       string `json:"label"`
+	Description string `json:"description,omitempty"`
+	// LabelKey and DescriptionKey name the texts Label and Description are
+	// rendered from in the default language, for clients to translate with
+	// Params. Only built-ins the server describes itself have them.
+	LabelKey       string     `json:"label_key,omitempty"`
+	DescriptionKey string     `json:"description_key,omitempty"`
+	Params         textParams `json:"params,omitempty"`
+	Category       string     `json:"category,omitempty"`
+	Builtin        bool       `json:"builtin"`
+	Size           int64      `json:"size"`
+	Lines          int        `json:"lines"`
+	Names          int        `json:"names"`
+	Checksum       string     `json:"checksum"`
+	UploadedAt     time.Time  `json:"uploaded_at"`
+	LastUsedAt     time.Time  `json:"last_used_at"`
+	path           string
+	// fsys holds lists compiled into the binary; path is relative to it.
+	// It is nil for files on disk. order is the list's position in the
+	// catalog, counting from 1.
+	fsys  fs.FS
+	order int
+}
+
+// describe sets the entry's texts to those of the given catalog keys.
+func (e *wordlistEntry) describe(labelKey, descriptionKey string, params textParams) {
+	e.LabelKey, e.DescriptionKey, e.Params = labelKey, descriptionKey, params
+	e.Label = render(labelKey, params)
+	e.Description = render(descriptionKey, params)
+}
+
+// open returns a reader of the wordlist's decompressed content.
+func (e *wordlistEntry) open() (io.ReadCloser, error) {
+	if e.fsys != nil {
+		return openWordlistFS(e.fsys, e.path)
+	}
+	return openWordlist(e.path)
+}
+
+// wordlistMeta is stored next to each upload as <id>.json. Besides the user
+// visible details it caches the statistics of the stored file, which remain
+// valid as long as its size matches, so neither startup nor scans have to
+// read the whole list to learn them.
+type wordlistMeta struct {
+	Label      string    `json:"label"`
+	UploadedAt time.Time `json:"uploaded_at"`
+	LastUsedAt time.Time `json:"last_used_at"`
+
+	Size     int64  `json:"size,omitempty"`
+	Lines    int    `json:"lines,omitempty"`
+	Names    int    `json:"names,omitempty"`
+	Checksum string `json:"checksum,omitempty"`
+}
+
+func (e *wordlistEntry) meta() wordlistMeta {
+	return wordlistMeta{
+		Label:      e.Label,
+		UploadedAt: e.UploadedAt,
+		LastUsedAt: e.LastUsedAt,
+		Size:       e.Size,
+		Lines:      e.Lines,
+		Names:      e.Names,
+		Checksum:   e.Checksum,
+	}
+}
+
+// wordlistRegistry maps opaque wordlist IDs to files. Scans can only use
+// wordlists that are registered, so client input is never turned into a path.
+type wordlistRegistry struct {
+	mu      sync.RWMutex
+	dir     string
+	entries map[string]*wordlistEntry
+	// pins counts the running scans using each upload, which must not be
+	// removed before they are done with it.
+	pins map[string]int
+}
+
+// newWordlistRegistry registers the lists compiled into the binary, any
+// further built-in lists in dir, keyed by file name without extension, and
+// the uploads in dir/temp, keyed by the SHA-256 of their content. Uploads
+// stored under other names by older versions are renamed to their hash, and
+// duplicates among them are removed.
+func newWordlistRegistry(dir string) (*wordlistRegistry, error) {
+	r := &wordlistRegistry{
+		dir:     dir,
+		entries: make(map[string]*wordlistEntry),
+		pins:    make(map[string]int),
+	}
+	if err := r.loadEmbedded(); err != nil {
+		return nil, err
+	}
+	if err := r.load(dir, true); err != nil {
+		return nil, err
+	}
+	if err := r.load(r.uploadDir(), false); err != nil {
+		return nil, err
+	}
+	log.Printf("Registered %d wordlists (%d embedded, the rest from %s)", len(r.entries), len(wordlists.Catalog), dir)
+	return r, nil
+}
+
+// loadEmbedded registers the lists in the wordlists catalog.
+func (r *wordlistRegistry) loadEmbedded() error {
+	fsys := wordlists.FS()
+	for i, list := range wordlists.Catalog {
+		info, err := fs.Stat(fsys, list.File)
+		if err != nil {
+			return fmt.Errorf("embedded wordlist %s: %w", list.ID, err)
+		}
+		entry := &wordlistEntry{
+			ID:       list.ID,
+			Category: list.Category,
+			Builtin:  true,
+			Size:     info.Size(),
+			path:     list.File,
+			fsys:     fsys,
+			order:    i + 1,
+		}
+		entry.describe("wordlist."+list.ID, "wordlist."+list.ID+".description", nil)
+		stats, err := entry.inspect()
+		if err != nil {
+			return fmt.Errorf("embedded wordlist %s: %w", list.ID, err)
+		}
+		entry.Lines, entry.Names, entry.Checksum = stats.lines, stats.names, stats.checksum
+		r.entries[list.ID] = entry
+	}
+	return nil
+}
+
+func (r *wordlistRegistry) load(dir string, builtin bool) error {
+	files, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("reading wordlist directory %s: %w", dir, err)
+	}
+	for _, f := range files {
+		if !builtin && filepath.Ext(f.Name()) == ".tmp" {
+			// Left behind by an interrupted upload.
+			os.Remove(filepath.Join(dir, f.Name()))
+			continue
+		}
+		id, ok := splitWordlistName(f.Name())
+		if f.IsDir() || !ok {
+			continue
+		}
+		path := filepath.Join(dir, f.Name())
+		if existing, ok := r.entries[id]; builtin && ok && existing.fsys != nil {
+			log.Printf("skipping wordlist %s: %q is the ID of an embedded list", f.Name(), id)
+			continue
+		}
+		if !builtin && !isContentID(id) {
+			if id, path, err = r.migrateUpload(id, strings.TrimPrefix(f.Name(), id)); err != nil {
+				log.Printf("skipping wordlist %s: %v", f.Name(), err)
+				continue
+			}
+			if _, ok := r.entries[id]; ok {
+				continue
+			}
+		}
+		entry, err := r.newEntry(id, path, builtin)
+		if err != nil {
+			log.Printf("skipping wordlist %s: %v", f.Name(), err)
+			continue
+		}
+		r.entries[id] = entry
+	}
+	return nil
+}
+
+// migrateUpload renames a legacy upload to the hash of its decompressed
+// content and returns the new ID and path. If the content is already stored,
+// the legacy copy is deleted.
+func (r *wordlistRegistry) migrateUpload(legacyID, ext string) (string, string, error) {
+	legacyPath := filepath.Join(r.uploadDir(), legacyID+ext)
+	id, err := hashFile(legacyPath)
+	if err != nil {
+		return "", "", err
+	}
+	if path, ok := r.findUpload(id); ok {
+		log.Printf("Removing duplicate upload %s (same content as %s)", legacyID, id)
+		os.Remove(legacyPath)
+		os.Remove(r.metaPath(legacyID))
+		return id, path, nil
+	}
+	path := filepath.Join(r.uploadDir(), id+ext)
+	if err := os.Rename(legacyPath, path); err != nil {
+		return "", "", err
+	}
+	if err := os.Rename(r.metaPath(legacyID), r.metaPath(id)); err != nil && !os.IsNotExist(err) {
+		return "", "", err
+	}
+	return id, path, nil
+}
+
+// findUpload returns the path of the upload stored under id in any of the
+// supported formats.
+func (r *wordlistRegistry) findUpload(id string) (string, bool) {
+	for _, ext := range wordlistExts {
+		path := filepath.Join(r.uploadDir(), id+ext)
+		if _, err := os.Stat(path); err == nil {
+			return path, true
+		}
+	}
+	return "", false
+}
+
+// isContentID reports whether id looks like a hex-encoded SHA-256.
+func isContentID(id string) bool {
+	if len(id) != sha256.Size*2 {
+		return false
+	}
+	_, err := hex.DecodeString(id)
+	return err == nil
+}
+
+func hashFile(path string) (string, error) {
+	file, err := openWordlist(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// newEntry describes the wordlist file at path. For uploads, the metadata
+// file supplies the label and, if still valid, the cached statistics;
+// otherwise the file is inspected and the cache rewritten.
+func (r *wordlistRegistry) newEntry(id, path string, builtin bool) (*wordlistEntry, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	entry := &wordlistEntry{
+		ID:         id,
+		Label:      id,
+		Builtin:    builtin,
+		Size:       info.Size(),
+		UploadedAt: info.ModTime(),
+		path:       path,
+	}
+
+	cached := false
+	if !builtin {
+		if meta, err := r.readMeta(id); err == nil {
+			entry.Label = meta.Label
+			entry.UploadedAt = meta.UploadedAt
+			entry.LastUsedAt = meta.LastUsedAt
+			if meta.Checksum != "" && meta.Size == info.Size() {
+				entry.Lines, entry.Names, entry.Checksum = meta.Lines, meta.Names, meta.Checksum
+				cached = true
+			}
+		}
+	}
+	if entry.LastUsedAt.IsZero() {
+		entry.LastUsedAt = entry.UploadedAt
+	}
+
+	if !cached {
+		stats, err := entry.inspect()
+		if err != nil {
+			return nil, err
+		}
+		entry.Lines, entry.Names, entry.Checksum = stats.lines, stats.names, stats.checksum
+		if !builtin {
+			if err := r.writeMeta(id, entry.meta()); err != nil {
+				log.Printf("error caching wordlist metadata %s: %v", id, err)
+			}
+		}
+	}
+	return entry, nil
+}
+
+// putBuiltin registers, or re-registers after it changed, a built-in list
+// the server maintains itself at path. Its texts are rendered from
+// details' LabelKey, DescriptionKey and Params; Category is taken as is.
+func (r *wordlistRegistry) putBuiltin(id, path string, details wordlistEntry) error {
+	entry, err := r.newEntry(id, path, true)
+	if err != nil {
+		return err
+	}
+	entry.describe(details.LabelKey, details.DescriptionKey, details.Params)
+	entry.Category = details.Category
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.entries[id] = entry
+	return nil
+}
+
+// uploadDir is where uploaded wordlists are stored.
+func (r *wordlistRegistry) uploadDir() string {
+	return filepath.Join(r.dir, uploadSubdir)
+}
+
+func (r *wordlistRegistry) metaPath(id string) string {
+	return filepath.Join(r.uploadDir(), id+".json")
+}
+
+func (r *wordlistRegistry) readMeta(id string) (wordlistMeta, error) {
+	var meta wordlistMeta
+	data, err := os.ReadFile(r.metaPath(id))
+	if err != nil {
+		return meta, err
+	}
+	err = json.Unmarshal(data, &meta)
+	return meta, err
+}
+
+func (r *wordlistRegistry) writeMeta(id string, meta wordlistMeta) error {
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(r.metaPath(id), data, 0o644)
+}
+
+// lookup returns the wordlist registered under id.
+func (r *wordlistRegistry) lookup(id string) (*wordlistEntry, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	entry, ok := r.entries[id]
+	return entry, ok
+}
+
+// list returns a snapshot of all registered wordlists: embedded lists in
+// catalog order, other built-ins, then uploads newest first.
+func (r *wordlistRegistry) list() []wordlistEntry {
+	r.mu.RLock()
+	entries := make([]wordlistEntry, 0, len(r.entries))
+	for _, entry := range r.entries {
+		entries = append(entries, *entry)
+	}
+	r.mu.RUnlock()
+
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Builtin != entries[j].Builtin {
+			return entries[i].Builtin
+		}
+		if entries[i].order != entries[j].order {
+			return entries[j].order == 0 || entries[i].order != 0 && entries[i].order < entries[j].order
+		}
+		if !entries[i].Builtin && !entries[i].UploadedAt.Equal(entries[j].UploadedAt) {
+			return entries[i].UploadedAt.After(entries[j].UploadedAt)
+		}
+		return entries[i].ID < entries[j].ID
+	})
+	return entries
+}
+
+// storeUpload saves the wordlist read from src under its content hash. If
+// the same content was uploaded before, the existing entry is returned with
+// duplicate set and its last-used time refreshed. The upload is inspected
+// while it is written, so the registry is only locked to add it.
+func (r *wordlistRegistry) storeUpload(src io.Reader, label string) (entry wordlistEntry, duplicate bool, err error) {
+	if err := os.MkdirAll(r.uploadDir(), os.ModePerm); err != nil {
+		return wordlistEntry{}, false, err
+	}
+	tmp, err := os.CreateTemp(r.uploadDir(), "upload-*.tmp")
+	if err != nil {
+		return wordlistEntry{}, false, err
+	}
+	defer os.Remove(tmp.Name())
+
+	// Uploads are stored compressed; the ID hashes the plain content.
+	zw, err := zstd.NewWriter(tmp)
+	if err != nil {
+		tmp.Close()
+		return wordlistEntry{}, false, err
+	}
+	stats, err := readStats(io.TeeReader(src, zw))
+	if closeErr := zw.Close(); err == nil {
+		err = closeErr
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return wordlistEntry{}, false, err
+	}
+	info, err := os.Stat(tmp.Name())
+	if err != nil {
+		return wordlistEntry{}, false, err
+	}
+	id := stats.checksum
+	now := time.Now()
+	entry = wordlistEntry{
+		ID:         id,
+		Label:      label,
+		Size:       info.Size(),
+		Lines:      stats.lines,
+		Names:      stats.names,
+		Checksum:   stats.checksum,
+		UploadedAt: now,
+		LastUsedAt: now,
+		path:       filepath.Join(r.uploadDir(), id+storedUploadExt),
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if existing, ok := r.entries[id]; ok {
+		existing.LastUsedAt = now
+		if err := r.writeMeta(id, existing.meta()); err != nil {
+			log.Printf("error updating wordlist metadata %s: %v", id, err)
+		}
+		return *existing, true, nil
+	}
+
+	if err := os.Rename(tmp.Name(), entry.path); err != nil {
+		return wordlistEntry{}, false, err
+	}
+	if err := r.writeMeta(id, entry.meta()); err != nil {
+		os.Remove(entry.path)
+		return wordlistEntry{}, false, err
+	}
+	r.entries[id] = &entry
+	return entry, false, nil
+}
+
+// acquire looks up the wordlist registered under id for a scan and pins it
+// until release is called, so that it is not removed while the scan reads
+// it. Both count as a use, which keeps the upload from being cleaned up.
+func (r *wordlistRegistry) acquire(id string) (*wordlistEntry, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	entry, ok := r.entries[id]
+	if !ok {
+		return nil, false
+	}
+	r.pins[id]++
+	r.touch(entry)
+	return entry, true
+}
+
+// release undoes acquire.
+func (r *wordlistRegistry) release(id string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.pins[id]--; r.pins[id] <= 0 {
+		delete(r.pins, id)
+	}
+	if entry, ok := r.entries[id]; ok {
+		r.touch(entry)
+	}
+}
+
+// touch records that an upload was just used. r.mu must be held.
+func (r *wordlistRegistry) touch(entry *wordlistEntry) {
+	if entry.Builtin {
+		return
+	}
+	entry.LastUsedAt = time.Now()
+	if err := r.writeMeta(entry.ID, entry.meta()); err != nil {
+		log.Printf("error updating wordlist metadata %s: %v", entry.ID, err)
+	}
+}
+
+// cleanup deletes uploads that have not been used for longer than ttl and
+// then, least recently used first, as many as needed to bring the total size
+// of uploads under maxTotal. A zero ttl or maxTotal disables that check.
+func (r *wordlistRegistry) cleanup(ttl time.Duration, maxTotal int64) {
+	var uploads []wordlistEntry
+	var total int64
+	for _, entry := range r.list() {
+		if !entry.Builtin {
+			uploads = append(uploads, entry)
+			total += entry.Size
+		}
+	}
+	sort.Slice(uploads, func(i, j int) bool {
+		return uploads[i].LastUsedAt.Before(uploads[j].LastUsedAt)
+	})
+
+	now := time.Now()
+	for _, entry := range uploads {
+		expired := ttl > 0 && now.Sub(entry.LastUsedAt) > ttl
+		oversized := maxTotal > 0 && total > maxTotal
+		if !expired && !oversized {
+			continue
+		}
+		if err := r.remove(entry.ID); errors.Is(err, errWordlistInUse) {
+			continue
+		} else if err != nil {
+			log.Printf("error removing stale wordlist %s: %v", entry.ID, err)
+			continue
+		}
+		total -= entry.Size
+		log.Printf("Removed stale wordlist %s (%s, last used %s)", entry.ID, entry.Label, entry.LastUsedAt.Format(time.RFC3339))
+	}
+}
+
+// runCleanup calls cleanup immediately and then every interval until the
+// process exits.
+func (r *wordlistRegistry) runCleanup(ttl time.Duration, maxTotal int64, interval time.Duration) {
+	if ttl <= 0 && maxTotal <= 0 {
+		return
+	}
+	for {
+		r.cleanup(ttl, maxTotal)
+		time.Sleep(interval)
+	}
+}
+
+// rename changes the label of an upload.
+func (r *wordlistRegistry) rename(id, label string) (wordlistEntry, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	entry, ok := r.entries[id]
+	if !ok {
+		return wordlistEntry{}, errWordlistNotFound
+	}
+	if entry.Builtin {
+		return wordlistEntry{}, errWordlistBuiltin
+	}
+	meta := entry.meta()
+	meta.Label = label
+	if err := r.writeMeta(id, meta); err != nil {
+		return wordlistEntry{}, err
+	}
+	entry.Label = label
+	return *entry, nil
+}
+
+// remove unregisters an upload and deletes its files.
+func (r *wordlistRegistry) remove(id string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	entry, ok := r.entries[id]
+	if !ok {
+		return errWordlistNotFound
+	}
+	if entry.Builtin {
+		return errWordlistBuiltin
+	}
+	if r.pins[id] > 0 {
+		return errWordlistInUse
+	}
+	if err := os.Remove(entry.path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Remove(r.metaPath(id)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	delete(r.entries, id)
+	return nil
+}
+
+// preview returns up to n lines from the start of the wordlist.
+func (r *wordlistRegistry) preview(id string, n int) ([]string, error) {
+	entry, ok := r.lookup(id)
+	if !ok {
+		return nil, errWordlistNotFound
+	}
+	file, err := entry.open()
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	lines := make([]string, 0, n)
+	scanner := bufio.NewScanner(file)
+	for len(lines) < n && scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	return lines, scanner.Err()
+}
+
+// wordlistStats summarizes a wordlist's content.
+type wordlistStats struct {
+	lines    int
+	names    int
+	checksum string
+}
+
+// inspect reads the wordlist once, counting its lines and the names they
+// expand to with the default template, and hashing its content.
+func (e *wordlistEntry) inspect() (wordlistStats, error) {
+	file, err := e.open()
+	if err != nil {
+		return wordlistStats{}, err
+	}
+	defer file.Close()
+	return readStats(file)
+}
+
+// readStats reads a wordlist's content from r to the end and returns its
+// statistics.
+func readStats(r io.Reader) (wordlistStats, error) {
+	template, _ := scanner.ParseTemplate("")
+	h := sha256.New()
+	var stats wordlistStats
+	err := readLines(io.TeeReader(r, h), func(line string) error {
+		stats.lines++
+		stats.names += template.Count(line)
+		return nil
+	})
+	if err != nil {
+		return wordlistStats{}, err
+	}
+	stats.checksum = hex.EncodeToString(h.Sum(nil))
+	return stats, nil
+}
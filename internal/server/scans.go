@@ -0,0 +1,346 @@
+package server
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"subsonic/internal/scanner"
+	"sync"
+	"time"
+)
+
+const (
+	// maxStoredScans is how many finished scans are kept; the oldest are
+	// forgotten first.
+	maxStoredScans = 50
+
+	// scanDir is where finished scans are saved, one JSON file per scan,
+	// so their results survive a restart.
+	scanDir = "scans"
+)
+
+// scanRecord is a scan and everything it found. Scans belong to the user who
+// started them; other users only see them once they are shared, admins
+// always do.
+type scanRecord struct {
+	ID      string `json:"id"`
+	Owner   string `json:"owner"`
+	Domain  string `json:"domain"`
+	Shared  bool   `json:"shared"`
+	Running bool   `json:"running"`
+	// Interrupted is set for scans stopped before they completed, e.g. by
+	// the server shutting down; their results are what was found until then.
+	Interrupted bool       `json:"interrupted,omitempty"`
+	Found       int        `json:"found"`
+	Summary     string     `json:"summary,omitempty"`
+	StartedAt   time.Time  `json:"started_at"`
+	FinishedAt  *time.Time `json:"finished_at,omitempty"`
+
+	results []scanner.ScanResult
+	// status is the payload of the last scan_status message, sent to
+	// clients that subscribe to the scan.
+	status json.RawMessage
+}
+
+// visibleTo reports whether user may see the scan.
+func (s *scanRecord) visibleTo(user identity) bool {
+	return s.Owner == user.Name || s.Shared || user.isAdmin()
+}
+
+// savedScan is the on-disk form of a finished scan.
+type savedScan struct {
+	Scan    scanRecord           `json:"scan"`
+	Status  json.RawMessage      `json:"status,omitempty"`
+	Results []scanner.ScanResult `json:"results"`
+}
+
+// scanStore keeps the recent scans in memory and saves the finished ones
+// to dir.
+type scanStore struct {
+	mu    sync.RWMutex
+	dir   string
+	scans map[string]*scanRecord
+}
+
+// newScanStore loads the scans saved in dir.
+func newScanStore(dir string) (*scanStore, error) {
+	s := &scanStore{dir: dir, scans: make(map[string]*scanRecord)}
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		var saved savedScan
+		if err := json.Unmarshal(data, &saved); err != nil || saved.Scan.ID == "" {
+			log.Printf("Skipping unreadable saved scan %s: %v", file, err)
+			continue
+		}
+		scan := saved.Scan
+		scan.Running = false
+		scan.results = saved.Results
+		scan.status = saved.Status
+		s.scans[scan.ID] = &scan
+	}
+	s.mu.Lock()
+	s.prune()
+	s.mu.Unlock()
+	return s, nil
+}
+
+// create records a new running scan of domain owned by owner.
+func (s *scanStore) create(owner identity, domain string) *scanRecord {
+	b := make([]byte, 8)
+	rand.Read(b)
+	scan := &scanRecord{
+		ID:        hex.EncodeToString(b),
+		Owner:     owner.Name,
+		Domain:    domain,
+		Running:   true,
+		StartedAt: time.Now(),
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.scans[scan.ID] = scan
+	s.prune()
+	return scan
+}
+
+// addResults appends results found by the scan with the given ID and
+// returns the sequence number of the last one.
+func (s *scanStore) addResults(id string, results []*scanner.ScanResult) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	scan, ok := s.scans[id]
+	if !ok {
+		return 0
+	}
+	for _, r := range results {
+		scan.results = append(scan.results, *r)
+	}
+	scan.Found = len(scan.results)
+	return scan.Found
+}
+
+// setStatus records the payload of the scan's latest scan_status message.
+func (s *scanStore) setStatus(id string, status json.RawMessage) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if scan, ok := s.scans[id]; ok {
+		scan.status = status
+	}
+}
+
+// snapshot returns the scan and its latest status, if user may see it.
+func (s *scanStore) snapshot(id string, user identity) (scanRecord, json.RawMessage, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	scan, ok := s.scans[id]
+	if !ok || !scan.visibleTo(user) {
+		return scanRecord{}, nil, false
+	}
+	return *scan, scan.status, true
+}
+
+// resultRange returns a copy of the scan's results numbered from+1 to to, as
+// far as it has them, and the number of the result before the first one
+// returned.
+func (s *scanStore) resultRange(id string, from, to int) ([]scanner.ScanResult, int) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	scan, ok := s.scans[id]
+	if !ok {
+		return nil, from
+	}
+	from, to = max(0, from), min(to, len(scan.results))
+	if from >= to {
+		return nil, from
+	}
+	return append([]scanner.ScanResult(nil), scan.results[from:to]...), from
+}
+
+// finish marks the scan as done, or as interrupted, with its final status
+// and saves it.
+func (s *scanStore) finish(id, summary string, status json.RawMessage, interrupted bool) {
+	s.mu.Lock()
+	scan, ok := s.scans[id]
+	if !ok {
+		s.mu.Unlock()
+		return
+	}
+	now := time.Now()
+	scan.Running = false
+	scan.Interrupted = interrupted
+	scan.Summary = summary
+	scan.status = status
+	scan.FinishedAt = &now
+	data, err := json.Marshal(savedScan{Scan: *scan, Status: scan.status, Results: scan.results})
+	s.prune()
+	s.mu.Unlock()
+
+	if err == nil {
+		err = writeFileAtomic(s.path(id), func(w *bufio.Writer) error {
+			_, err := w.Write(data)
+			return err
+		})
+	}
+	if err != nil {
+		log.Printf("error saving scan %s: %v", id, err)
+	}
+}
+
+func (s *scanStore) path(id string) string {
+	return filepath.Join(s.dir, id+".json")
+}
+
+// prune forgets the oldest finished scans beyond maxStoredScans.
+func (s *scanStore) prune() {
+	var finished []*scanRecord
+	for _, scan := range s.scans {
+		if !scan.Running {
+			finished = append(finished, scan)
+		}
+	}
+	if len(finished) <= maxStoredScans {
+		return
+	}
+	sort.Slice(finished, func(i, j int) bool {
+		return finished[i].StartedAt.Before(finished[j].StartedAt)
+	})
+	for _, scan := range finished[:len(finished)-maxStoredScans] {
+		delete(s.scans, scan.ID)
+		if err := os.Remove(s.path(scan.ID)); err != nil && !os.IsNotExist(err) {
+			log.Printf("error removing saved scan %s: %v", scan.ID, err)
+		}
+	}
+}
+
+// list returns the scans user may see, newest first.
+func (s *scanStore) list(user identity) []scanRecord {
+	s.mu.RLock()
+	scans := make([]scanRecord, 0, len(s.scans))
+	for _, scan := range s.scans {
+		if scan.visibleTo(user) {
+			scans = append(scans, *scan)
+		}
+	}
+	s.mu.RUnlock()
+	sort.Slice(scans, func(i, j int) bool {
+		return scans[i].StartedAt.After(scans[j].StartedAt)
+	})
+	return scans
+}
+
+// get returns the scan and a copy of its results if user may see it.
+func (s *scanStore) get(id string, user identity) (scanRecord, []scanner.ScanResult, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	scan, ok := s.scans[id]
+	if !ok || !scan.visibleTo(user) {
+		return scanRecord{}, nil, false
+	}
+	return *scan, append([]scanner.ScanResult(nil), scan.results...), true
+}
+
+// share makes the scan visible to everyone, or private again. Only the
+// owner and admins may do so.
+func (s *scanStore) share(id string, user identity, shared bool) (scanRecord, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	scan, ok := s.scans[id]
+	if !ok || scan.Owner != user.Name && !user.isAdmin() {
+		return scanRecord{}, false
+	}
+	scan.Shared = shared
+	return *scan, true
+}
+
+// registerScanAPI adds the endpoints for starting, following, browsing and
+// sharing scans to mux.
+func registerScanAPI(mux *http.ServeMux, hub *Hub) {
+	scans := hub.scans
+
+	mux.HandleFunc("POST /api/scans", func(w http.ResponseWriter, r *http.Request) {
+		serveStartScan(hub, w, r)
+	})
+
+	mux.HandleFunc("GET /api/scans/{id}/events", func(w http.ResponseWriter, r *http.Request) {
+		serveEvents(hub, w, r)
+	})
+
+	mux.HandleFunc("GET /api/scans", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, scans.list(requestIdentity(r)))
+	})
+
+	mux.HandleFunc("GET /api/scans/{id}", func(w http.ResponseWriter, r *http.Request) {
+		scan, results, ok := scans.get(r.PathValue("id"), requestIdentity(r))
+		if !ok {
+			http.Error(w, "Scan not found", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"scan":    scan,
+			"results": results,
+		})
+	})
+
+	mux.HandleFunc("PATCH /api/scans/{id}", func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Shared bool `json:"shared"`
+		}
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&body); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		scan, ok := scans.share(r.PathValue("id"), requestIdentity(r), body.Shared)
+		if !ok {
+			http.Error(w, "Scan not found", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, http.StatusOK, scan)
+	})
+}
+
+// serveStartScan starts a scan with the options of a start_scan message and
+// answers with its scan_started payload once it runs, so clients without a
+// websocket can follow it through its event stream. Errors are sent as the
+// payload of a scan_error message, in the language of Accept-Language.
+func serveStartScan(hub *Hub, w http.ResponseWriter, r *http.Request) {
+	var payload StartScanPayload
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxMessageSize)).Decode(&payload); err != nil {
+		scanErr := newScanError(errInvalidPayload, "error.invalid_scan_payload", textParams{"detail": err.Error()})
+		writeJSON(w, http.StatusBadRequest, scanErr.localize(catalogForRequest(r)))
+		return
+	}
+
+	started := make(chan ScanStartedPayload, 1)
+	failed := make(chan *ScanError, 1)
+	go func() {
+		// runScan returns nil once a scan that started is over, which must
+		// not race with started.
+		if scanErr := hub.runScan(requestIdentity(r), payload, func(scan ScanStartedPayload) { started <- scan }); scanErr != nil {
+			failed <- scanErr
+		}
+	}()
+	select {
+	case scan := <-started:
+		writeJSON(w, http.StatusAccepted, scan)
+	case scanErr := <-failed:
+		log.Printf("scan error: %v", scanErr)
+		status := http.StatusBadRequest
+		if scanErr.Code == errShuttingDown {
+			status = http.StatusServiceUnavailable
+		}
+		writeJSON(w, status, scanErr.localize(catalogForRequest(r)))
+	}
+}
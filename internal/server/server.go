@@ -1,31 +1,116 @@
 package server
 
 import (
-	"encoding/json"
-	"io"
+	"context"
 	"io/fs"
 	"log"
+	"net"
 	"net/http"
 	"os"
-	"path/filepath"
+	"os/signal"
 	"strings"
+	"syscall"
+	"time"
+)
 
-	"github.com/google/uuid"
+const (
+	// uploadCleanupInterval is how often stale uploads are looked for.
+	uploadCleanupInterval = time.Hour
+	// shutdownTimeout bounds how long scans and requests in flight are
+	// waited for on shutdown.
+	shutdownTimeout = 30 * time.Second
 )
 
-func Serve(distFS fs.FS, debugNetwork bool, port string) {
-	hub := NewHub(debugNetwork)
+// Config holds the server settings taken from the command line.
+type Config struct {
+	// Host is the address to listen on, e.g. 127.0.0.1 to accept local
+	// connections only; empty listens on all interfaces.
+	Host         string
+	Port         string
+	DebugNetwork bool
+
+	// TLSCert and TLSKey are the certificate and key files to serve HTTPS
+	// with. TLSSelfSigned serves HTTPS with a certificate generated on
+	// first run instead.
+	TLSCert       string
+	TLSKey        string
+	TLSSelfSigned bool
+
+	// MaxUploadSize is the largest accepted wordlist upload in bytes.
+	MaxUploadSize int64
+	// UploadTTL removes uploads unused for longer than this; zero keeps them.
+	UploadTTL time.Duration
+	// MaxUploadsSize caps the total size of stored uploads in bytes,
+	// removing the least recently used first; zero means no cap.
+	MaxUploadsSize int64
+
+	// Password is set as the password of the "admin" account, creating it
+	// if needed. AuthTokens are accepted as bearer tokens by the API and
+	// websocket and, with an empty user name, by the UI login; they carry
+	// admin rights. Authentication is off without tokens and accounts.
+	Password   string
+	AuthTokens []string
+	// AllowedOrigins are web origins besides the server's own that may use
+	// the API and websocket, e.g. a frontend development server.
+	AllowedOrigins []string
+}
+
+func Serve(distFS fs.FS, cfg Config) {
+	certFile, keyFile, err := cfg.tlsFiles()
+	if err != nil {
+		log.Fatalf("Failed to set up TLS: %v", err)
+	}
+
+	wordlists, err := newWordlistRegistry(wordlistDir)
+	if err != nil {
+		log.Fatalf("Failed to load wordlists: %v", err)
+	}
+	go wordlists.runCleanup(cfg.UploadTTL, cfg.MaxUploadsSize, uploadCleanupInterval)
+	learned, err := newLearnedWordlist(wordlists)
+	if err != nil {
+		log.Fatalf("Failed to load learned wordlist: %v", err)
+	}
+
+	scans, err := newScanStore(scanDir)
+	if err != nil {
+		log.Fatalf("Failed to load saved scans: %v", err)
+	}
+	hub := NewHub(cfg.DebugNetwork, wordlists, learned, scans)
 	go hub.Run()
 
+	users, err := newUserStore(usersFile)
+	if err != nil {
+		log.Fatalf("Failed to load users: %v", err)
+	}
+	if cfg.Password != "" {
+		if err := users.ensureAdmin(cfg.Password); err != nil {
+			log.Fatalf("Failed to set the admin password: %v", err)
+		}
+	}
+	auth := newAuthenticator(users, cfg.AuthTokens, cfg.AllowedOrigins)
+	if !auth.enabled() {
+		log.Println("Warning: authentication is disabled; anyone who can reach this port can run scans. Set -password or -auth-token to enable it.")
+	}
+
 	mux := http.NewServeMux()
 
 	// API endpoint for WebSocket
 	mux.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
-		serveWs(hub, w, r)
+		serveWs(hub, auth, w, r)
 	})
 
-	// API endpoint for file uploads
-	mux.HandleFunc("/api/upload-wordlist", handleUploadWordlist)
+	// API endpoints for logging in and managing users
+	registerAuthAPI(mux, auth)
+	registerUserAPI(mux, users)
+
+	// API endpoints serving the translation catalogs
+	registerI18nAPI(mux)
+
+	// API endpoints for starting, following and sharing scans
+	registerScanAPI(mux, hub)
+
+	// API endpoints for uploading and managing wordlists
+	registerWordlistAPI(mux, wordlists, cfg.MaxUploadSize)
 
 	// Static file serving
 	staticFS := http.FS(distFS)
@@ -38,7 +123,7 @@ func Serve(distFS fs.FS, debugNetwork bool, port string) {
 
 	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		cleanPath := strings.TrimPrefix(r.URL.Path, "/")
-		
+
 		if _, err := distFS.Open(cleanPath); os.IsNotExist(err) {
 			w.Header().Set("Content-Type", "text/html; charset=utf-8")
 			w.Write(htmlContent)
@@ -47,51 +132,42 @@ func Serve(distFS fs.FS, debugNetwork bool, port string) {
 		}
 	})
 
-	addr := ":" + port
-	log.Printf("Server starting on %s", addr)
-	if err := http.ListenAndServe(addr, mux); err != nil {
-		log.Fatalf("http.ListenAndServe: %v", err)
-	}
-}
-
-func handleUploadWordlist(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
+	srv := &http.Server{
+		Addr:    net.JoinHostPort(cfg.Host, cfg.Port),
+		Handler: auth.middleware(mux),
 	}
-
-	uploadDir := filepath.Join(".", "wordlists", "temp")
-	if err := os.MkdirAll(uploadDir, os.ModePerm); err != nil {
-		http.Error(w, "Failed to create upload directory", http.StatusInternalServerError)
-		return
-	}
-
-	r.ParseMultipartForm(1 << 30)
-
-	file, _, err := r.FormFile("wordlist")
-	if err != nil {
-		http.Error(w, "Invalid file upload", http.StatusBadRequest)
-		return
-	}
-	defer file.Close()
-
-	tempFileName := uuid.New().String() + ".txt"
-	tempFilePath := filepath.Join(uploadDir, tempFileName)
-	tempFile, err := os.Create(tempFilePath)
-	if err != nil {
-		http.Error(w, "Failed to create temporary file", http.StatusInternalServerError)
-		return
-	}
-	defer tempFile.Close()
-
-	if _, err := io.Copy(tempFile, file); err != nil {
-		http.Error(w, "Failed to save file", http.StatusInternalServerError)
-		return
+	serveErr := make(chan error, 1)
+	go func() {
+		if certFile != "" {
+			log.Printf("Server starting on %s (HTTPS)", srv.Addr)
+			serveErr <- srv.ListenAndServeTLS(certFile, keyFile)
+			return
+		}
+		log.Printf("Server starting on %s", srv.Addr)
+		serveErr <- srv.ListenAndServe()
+	}()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	select {
+	case err := <-serveErr:
+		log.Fatalf("Server failed: %v", err)
+	case <-ctx.Done():
 	}
-
-	response := map[string]string{
-		"wordlist_key": "temp/" + tempFileName,
+	// A second signal kills the process right away.
+	stop()
+
+	log.Println("Shutting down, press Ctrl+C again to force...")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	// Shutdown stops accepting connections and waits for requests in
+	// flight, such as uploads, while the hub stops the scans.
+	httpDone := make(chan error, 1)
+	go func() {
+		httpDone <- srv.Shutdown(shutdownCtx)
+	}()
+	hub.Shutdown(shutdownCtx)
+	if err := <-httpDone; err != nil {
+		log.Printf("error shutting down the HTTP server: %v", err)
 	}
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(response)
+	log.Println("Server stopped")
 }
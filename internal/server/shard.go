@@ -0,0 +1,70 @@
+package server
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Shard modes accepted in start_scan messages.
+const (
+	shardInterleave = "interleave"
+	shardContiguous = "contiguous"
+)
+
+// shardSpec selects the part of a wordlist one host scans when a scan is
+// split across several. Words are numbered in the order they are streamed,
+// after duplicates between combined lists are removed. Interleaved shards
+// take every count-th word starting at index; contiguous shards take the
+// index-th of count equal slices.
+type shardSpec struct {
+	index      int
+	count      int
+	contiguous bool
+}
+
+// parseShard parses "i/N", where i counts from 1. An empty spec means the
+// whole wordlist.
+func parseShard(spec, mode string) (shardSpec, error) {
+	if spec == "" {
+		return shardSpec{}, nil
+	}
+	iStr, nStr, ok := strings.Cut(strings.TrimSpace(spec), "/")
+	i, errI := strconv.Atoi(strings.TrimSpace(iStr))
+	n, errN := strconv.Atoi(strings.TrimSpace(nStr))
+	if !ok || errI != nil || errN != nil || n < 1 || i < 1 || i > n {
+		return shardSpec{}, fmt.Errorf("shard must look like i/N with 1 <= i <= N, got %q", spec)
+	}
+
+	shard := shardSpec{index: i - 1, count: n}
+	switch mode {
+	case "", shardInterleave:
+	case shardContiguous:
+		shard.contiguous = true
+	default:
+		return shardSpec{}, fmt.Errorf("unknown shard mode %q", mode)
+	}
+	return shard, nil
+}
+
+// active reports whether the shard leaves out any words.
+func (s shardSpec) active() bool {
+	return s.count > 1
+}
+
+// bounds returns the half-open range of word numbers a contiguous shard of
+// a list of total words covers.
+func (s shardSpec) bounds(total int) (int, int) {
+	return total * s.index / s.count, total * (s.index + 1) / s.count
+}
+
+func (s shardSpec) String() string {
+	if !s.active() {
+		return "all"
+	}
+	mode := shardInterleave
+	if s.contiguous {
+		mode = shardContiguous
+	}
+	return fmt.Sprintf("%d/%d (%s)", s.index+1, s.count, mode)
+}
@@ -0,0 +1,97 @@
+package server
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestParseShard(t *testing.T) {
+	tests := []struct {
+		spec, mode string
+		want       shardSpec
+		wantErr    bool
+	}{
+		{"", "", shardSpec{}, false},
+		{"", "bogus", shardSpec{}, false},
+		{"1/1", "", shardSpec{index: 0, count: 1}, false},
+		{"1/4", "", shardSpec{index: 0, count: 4}, false},
+		{"4/4", "interleave", shardSpec{index: 3, count: 4}, false},
+		{" 2 / 3 ", "contiguous", shardSpec{index: 1, count: 3, contiguous: true}, false},
+		{"0/4", "", shardSpec{}, true},
+		{"5/4", "", shardSpec{}, true},
+		{"1/0", "", shardSpec{}, true},
+		{"-1/4", "", shardSpec{}, true},
+		{"1/-4", "", shardSpec{}, true},
+		{"2", "", shardSpec{}, true},
+		{"a/b", "", shardSpec{}, true},
+		{"1/2/3", "", shardSpec{}, true},
+		{"1/2", "striped", shardSpec{}, true},
+	}
+	for _, tt := range tests {
+		got, err := parseShard(tt.spec, tt.mode)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseShard(%q, %q) error = %v, wantErr %v", tt.spec, tt.mode, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("parseShard(%q, %q) = %+v, want %+v", tt.spec, tt.mode, got, tt.want)
+		}
+	}
+}
+
+func TestShardBounds(t *testing.T) {
+	for _, total := range []int{0, 1, 2, 7, 10, 100, 1001} {
+		for count := 1; count <= 8; count++ {
+			next := 0
+			for index := 0; index < count; index++ {
+				lo, hi := shardSpec{index: index, count: count, contiguous: true}.bounds(total)
+				if lo != next || hi < lo || hi-lo > total/count+1 {
+					t.Errorf("bounds(%d) of shard %d/%d = [%d, %d), want to start at %d with at most %d words",
+						total, index+1, count, lo, hi, next, total/count+1)
+				}
+				next = hi
+			}
+			if next != total {
+				t.Errorf("shards of %d covered %d words of %d", count, next, total)
+			}
+		}
+	}
+}
+
+func TestShardedSourcesPartitionWords(t *testing.T) {
+	words := make([]string, 23)
+	for i := range words {
+		words[i] = fmt.Sprintf("w%d", i)
+	}
+	for _, mode := range []string{shardInterleave, shardContiguous} {
+		for count := 1; count <= 5; count++ {
+			var all []string
+			for index := 1; index <= count; index++ {
+				shard, err := parseShard(fmt.Sprintf("%d/%d", index, count), mode)
+				if err != nil {
+					t.Fatal(err)
+				}
+				var got []string
+				source := wordlistSource{words: words, shard: shard}
+				if err := source.each(func(word string) { got = append(got, word) }); err != nil {
+					t.Fatal(err)
+				}
+				if len(got) < len(words)/count || len(got) > len(words)/count+1 {
+					t.Errorf("%s shard %d/%d has %d words, want %d or %d", mode, index, count, len(got), len(words)/count, len(words)/count+1)
+				}
+				all = append(all, got...)
+			}
+			seen := make(map[string]bool, len(all))
+			for _, word := range all {
+				seen[word] = true
+			}
+			if len(all) != len(words) || len(seen) != len(words) {
+				t.Errorf("%s shards of %d gave %d words, %d distinct, want each of %d once", mode, count, len(all), len(seen), len(words))
+			}
+			if mode == shardContiguous && !reflect.DeepEqual(all, words) {
+				t.Errorf("contiguous shards of %d gave %q, want the list in order", count, all)
+			}
+		}
+	}
+}
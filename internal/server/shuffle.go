@@ -0,0 +1,47 @@
+package server
+
+import "math/rand"
+
+// shuffleWindow is how many words the shuffler holds back. Words can move
+// anywhere within about this distance of their position in the list, which
+// is enough to break up alphabetical runs while memory stays bounded no
+// matter how large the list is.
+const shuffleWindow = 1 << 16
+
+// windowShuffler randomizes the order of a stream of words using a fixed
+// size buffer: each incoming word replaces a randomly chosen buffered word,
+// which is emitted in its place. The same seed and input produce the same
+// order.
+type windowShuffler struct {
+	buf  []string
+	rng  *rand.Rand
+	emit func(string)
+}
+
+func newWindowShuffler(seed int64, emit func(string)) *windowShuffler {
+	return &windowShuffler{
+		rng:  rand.New(rand.NewSource(seed)),
+		emit: emit,
+	}
+}
+
+func (s *windowShuffler) add(word string) {
+	if len(s.buf) < shuffleWindow {
+		s.buf = append(s.buf, word)
+		return
+	}
+	i := s.rng.Intn(len(s.buf))
+	s.emit(s.buf[i])
+	s.buf[i] = word
+}
+
+// flush emits the buffered words in random order.
+func (s *windowShuffler) flush() {
+	s.rng.Shuffle(len(s.buf), func(i, j int) {
+		s.buf[i], s.buf[j] = s.buf[j], s.buf[i]
+	})
+	for _, word := range s.buf {
+		s.emit(word)
+	}
+	s.buf = s.buf[:0]
+}
@@ -0,0 +1,63 @@
+package server
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func shuffleWords(seed int64, words []string) []string {
+	var out []string
+	s := newWindowShuffler(seed, func(word string) { out = append(out, word) })
+	for _, word := range words {
+		s.add(word)
+	}
+	s.flush()
+	return out
+}
+
+func TestWindowShuffler(t *testing.T) {
+	for _, n := range []int{0, 1, 2, 100, shuffleWindow, shuffleWindow + 1, 3*shuffleWindow + 17} {
+		words := make([]string, n)
+		for i := range words {
+			words[i] = fmt.Sprintf("w%07d", i)
+		}
+
+		got := shuffleWords(42, words)
+		if again := shuffleWords(42, words); !reflect.DeepEqual(got, again) {
+			t.Errorf("%d words: the same seed gave different orders", n)
+		}
+		if n >= 100 {
+			if reflect.DeepEqual(got, words) {
+				t.Errorf("%d words: order unchanged", n)
+			}
+			if other := shuffleWords(43, words); reflect.DeepEqual(got, other) {
+				t.Errorf("%d words: seeds 42 and 43 gave the same order", n)
+			}
+		}
+
+		sorted := append([]string(nil), got...)
+		sort.Strings(sorted)
+		if len(sorted) != len(words) || len(words) > 0 && !reflect.DeepEqual(sorted, words) {
+			t.Errorf("%d words: shuffled output is not a permutation of the input", n)
+		}
+	}
+}
+
+func TestWindowShufflerBoundsDisplacement(t *testing.T) {
+	// A word is emitted no earlier than shuffleWindow positions before its
+	// own: nothing past it has been read at that point.
+	n := 4 * shuffleWindow
+	index := make(map[string]int, n)
+	words := make([]string, n)
+	for i := range words {
+		words[i] = fmt.Sprintf("w%07d", i)
+		index[words[i]] = i
+	}
+	for pos, word := range shuffleWords(7, words) {
+		if index[word] > pos+shuffleWindow {
+			t.Fatalf("word %d emitted at position %d, more than %d early", index[word], pos, shuffleWindow)
+		}
+	}
+}
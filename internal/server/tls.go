@@ -0,0 +1,110 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"log"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	selfSignedDir  = "tls"
+	selfSignedCert = "cert.pem"
+	selfSignedKey  = "key.pem"
+
+	// selfSignedValidity is how long a generated certificate is valid. It is
+	// replaced on the first start after it expires or comes close to.
+	selfSignedValidity = 365 * 24 * time.Hour
+	selfSignedRenewal  = 7 * 24 * time.Hour
+)
+
+// tlsFiles returns the certificate and key files to serve with, or empty
+// strings to serve plain HTTP. With SelfSigned a certificate is generated
+// into selfSignedDir on first run and reused afterwards.
+func (cfg Config) tlsFiles() (certFile, keyFile string, err error) {
+	switch {
+	case cfg.TLSSelfSigned && (cfg.TLSCert != "" || cfg.TLSKey != ""):
+		return "", "", fmt.Errorf("a self-signed certificate cannot be combined with -tls-cert and -tls-key")
+	case cfg.TLSSelfSigned:
+		certFile = filepath.Join(selfSignedDir, selfSignedCert)
+		keyFile = filepath.Join(selfSignedDir, selfSignedKey)
+		if err := ensureSelfSigned(certFile, keyFile, cfg.Host); err != nil {
+			return "", "", fmt.Errorf("generating a self-signed certificate: %w", err)
+		}
+		return certFile, keyFile, nil
+	case (cfg.TLSCert == "") != (cfg.TLSKey == ""):
+		return "", "", fmt.Errorf("-tls-cert and -tls-key must be given together")
+	}
+	return cfg.TLSCert, cfg.TLSKey, nil
+}
+
+// ensureSelfSigned generates a self-signed certificate for localhost, the
+// machine's host name and host unless a usable one already exists.
+func ensureSelfSigned(certFile, keyFile, host string) error {
+	if pair, err := tls.LoadX509KeyPair(certFile, keyFile); err == nil && pair.Leaf != nil {
+		if time.Until(pair.Leaf.NotAfter) > selfSignedRenewal {
+			return nil
+		}
+		log.Printf("Self-signed certificate %s expires %s, generating a new one", certFile, pair.Leaf.NotAfter.Format(time.DateOnly))
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "subsonic"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(selfSignedValidity),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+	if name, err := os.Hostname(); err == nil && name != "localhost" {
+		template.DNSNames = append(template.DNSNames, name)
+	}
+	if ip := net.ParseIP(host); ip != nil && !ip.IsUnspecified() && !ip.IsLoopback() {
+		template.IPAddresses = append(template.IPAddresses, ip)
+	} else if ip == nil && host != "" && host != "localhost" {
+		template.DNSNames = append(template.DNSNames, host)
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(certFile), 0o700); err != nil {
+		return err
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		return err
+	}
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o644); err != nil {
+		return err
+	}
+	log.Printf("Generated self-signed certificate %s for %v %v", certFile, template.DNSNames, template.IPAddresses)
+	return nil
+}
@@ -2,19 +2,77 @@ package server
 
 import "encoding/json"
 
-// Message represents a message sent over the WebSocket connection.
+// Message represents a message sent over the WebSocket connection, see
+// ProtocolVersion. ID is chosen by the client for a command and echoed in
+// the server's answers to it. Seq numbers the server's messages on a
+// connection. ScanID identifies the scan that messages from the server are
+// about. ResultSeq is set on scan_results messages: results are numbered
+// from 1 in the order a scan found them, and it is the number of the
+// batch's last result.
 type Message struct {
-	Type    string          `json:"type"`
-	Payload json.RawMessage `json:"payload"`
+	Type      string          `json:"type"`
+	ID        string          `json:"id,omitempty"`
+	Seq       int64           `json:"seq,omitempty"`
+	ScanID    string          `json:"scan_id,omitempty"`
+	ResultSeq int             `json:"result_seq,omitempty"`
+	Payload   json.RawMessage `json:"payload"`
+
+	// localizer is the payload, if it has texts to translate.
+	localizer localizer
+	// results is the payload of scan_results, which is encoded when the
+	// message is written, in the encoding the client asked for.
+	results ScanResultsPayload
+}
+
+// SubscribeScanPayload is the payload for a subscribe_scan message. The
+// server replies with the scan's results numbered above AfterSeq and its
+// current status, then keeps the client updated. Clients resubscribe after
+// reconnecting with the highest ResultSeq they have seen, so nothing
+// published while they were away is missed.
+type SubscribeScanPayload struct {
+	ScanID   string `json:"scan_id"`
+	AfterSeq int    `json:"after_seq"`
 }
 
 // StartScanPayload is the payload for a start_scan message.
 type StartScanPayload struct {
-	Domain      string   `json:"domain"`
-	WordlistKey string   `json:"wordlist_key,omitempty"`
-	DNSServers  []string `json:"dns_servers,omitempty"`
-	Concurrency int      `json:"concurrency,omitempty"`
-	Adaptive    bool     `json:"adaptive,omitempty"`
-	MaxQPS      int      `json:"maxQPS,omitempty"`
-	EnableRetry bool     `json:"enable_retry,omitempty"`
+	Domain      string `json:"domain"`
+	WordlistKey string `json:"wordlist_key,omitempty"`
+	// WordlistKeys selects further registered wordlists to combine with
+	// WordlistKey; words found in more than one list are scanned once.
+	WordlistKeys []string `json:"wordlist_keys,omitempty"`
+	// Wordlist is an inline list of words, either a JSON array or a string
+	// of newline-separated words. It takes precedence over the keys.
+	Wordlist    json.RawMessage `json:"wordlist,omitempty"`
+	DNSServers  []string        `json:"dns_servers,omitempty"`
+	Concurrency int             `json:"concurrency,omitempty"`
+	Adaptive    bool            `json:"adaptive,omitempty"`
+	MaxQPS      int             `json:"maxQPS,omitempty"`
+	EnableRetry bool            `json:"enable_retry,omitempty"`
+	Template    string          `json:"template,omitempty"`
+
+	// Shard restricts the scan to part of the wordlist, as "i/N" with i
+	// counting from 1, so one scan can be split across hosts. ShardMode is
+	// "interleave" (every Nth word, the default) or "contiguous" (the i-th
+	// of N slices). Recursion always uses the whole recursion wordlist.
+	Shard     string `json:"shard,omitempty"`
+	ShardMode string `json:"shard_mode,omitempty"`
+
+	// Shuffle randomizes the order names are queried in. A non-zero
+	// ShuffleSeed makes the order reproducible.
+	Shuffle     bool  `json:"shuffle,omitempty"`
+	ShuffleSeed int64 `json:"shuffle_seed,omitempty"`
+	// PrioritizeLearned queries the wordlist's words that past scans found
+	// most often first, see learnedWordlist.
+	PrioritizeLearned bool `json:"prioritize_learned,omitempty"`
+
+	RecursionDepth       int      `json:"recursion_depth,omitempty"`
+	RecursionLabels      []string `json:"recursion_labels,omitempty"`
+	RecursionWordlistKey string   `json:"recursion_wordlist_key,omitempty"`
+
+	Permutations     bool     `json:"permutations,omitempty"`
+	PermutationWords []string `json:"permutation_words,omitempty"`
+
+	// shard is Shard and ShardMode parsed by validate.
+	shard shardSpec
 }
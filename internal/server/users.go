@@ -0,0 +1,330 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	usersFile = "users.json"
+
+	roleAdmin = "admin"
+	roleUser  = "user"
+
+	// adminUser is the account the -password flag sets the password of.
+	adminUser = "admin"
+
+	minPasswordLength = 8
+)
+
+var (
+	errUserNotFound   = errors.New("user not found")
+	errUserExists     = errors.New("user already exists")
+	errInvalidUser    = errors.New("user names are 1-32 letters, digits, '.', '_' or '-'")
+	errInvalidRole    = errors.New("role must be \"admin\" or \"user\"")
+	errWeakPassword   = fmt.Errorf("passwords need at least %d characters", minPasswordLength)
+	errLastAdmin      = errors.New("the last admin cannot be removed or demoted")
+	errBadCredentials = errors.New("invalid user name or password")
+
+	validUserName = regexp.MustCompile(`^[A-Za-z0-9._-]{1,32}$`)
+)
+
+// identity is who a request or websocket connection acts for.
+type identity struct {
+	Name string `json:"name"`
+	Role string `json:"role"`
+}
+
+func (id identity) isAdmin() bool {
+	return id.Role == roleAdmin
+}
+
+// anonymous is the identity of every request when authentication is off:
+// a single user who may do everything.
+var anonymous = identity{Name: "", Role: roleAdmin}
+
+// account is a user as stored in usersFile.
+type account struct {
+	Name         string    `json:"name"`
+	Role         string    `json:"role"`
+	PasswordHash string    `json:"password_hash"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// userStore keeps the accounts in a JSON file, rewritten on every change.
+type userStore struct {
+	mu       sync.RWMutex
+	path     string
+	accounts map[string]*account
+}
+
+func newUserStore(path string) (*userStore, error) {
+	s := &userStore{path: path, accounts: make(map[string]*account)}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var accounts []*account
+	if err := json.Unmarshal(data, &accounts); err != nil {
+		return nil, fmt.Errorf("reading %s: %w", path, err)
+	}
+	for _, a := range accounts {
+		s.accounts[a.Name] = a
+	}
+	return s, nil
+}
+
+// empty reports whether no accounts exist.
+func (s *userStore) empty() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.accounts) == 0
+}
+
+// authenticate checks name and password and returns the user's identity.
+func (s *userStore) authenticate(name, password string) (identity, error) {
+	s.mu.RLock()
+	a, ok := s.accounts[name]
+	s.mu.RUnlock()
+	if !ok {
+		// Spend the same time as for a wrong password.
+		bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+		return identity{}, errBadCredentials
+	}
+	if bcrypt.CompareHashAndPassword([]byte(a.PasswordHash), []byte(password)) != nil {
+		return identity{}, errBadCredentials
+	}
+	return identity{Name: a.Name, Role: a.Role}, nil
+}
+
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("dummy password"), bcrypt.DefaultCost)
+
+// lookup returns the current identity of the user called name, so that role
+// changes and deletions take effect on existing sessions.
+func (s *userStore) lookup(name string) (identity, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	a, ok := s.accounts[name]
+	if !ok {
+		return identity{}, false
+	}
+	return identity{Name: a.Name, Role: a.Role}, true
+}
+
+// list returns all users sorted by name.
+func (s *userStore) list() []identity {
+	s.mu.RLock()
+	users := make([]identity, 0, len(s.accounts))
+	for _, a := range s.accounts {
+		users = append(users, identity{Name: a.Name, Role: a.Role})
+	}
+	s.mu.RUnlock()
+	sort.Slice(users, func(i, j int) bool { return users[i].Name < users[j].Name })
+	return users
+}
+
+// create adds a user.
+func (s *userStore) create(name, password, role string) error {
+	if !validUserName.MatchString(name) {
+		return errInvalidUser
+	}
+	if role != roleAdmin && role != roleUser {
+		return errInvalidRole
+	}
+	hash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.accounts[name]; ok {
+		return errUserExists
+	}
+	s.accounts[name] = &account{Name: name, Role: role, PasswordHash: hash, CreatedAt: time.Now()}
+	return s.save()
+}
+
+// update changes a user's password and/or role; empty values are left
+// alone.
+func (s *userStore) update(name, password, role string) error {
+	if role != "" && role != roleAdmin && role != roleUser {
+		return errInvalidRole
+	}
+	var hash string
+	if password != "" {
+		var err error
+		if hash, err = hashPassword(password); err != nil {
+			return err
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	a, ok := s.accounts[name]
+	if !ok {
+		return errUserNotFound
+	}
+	if role == roleUser && a.Role == roleAdmin && s.admins() == 1 {
+		return errLastAdmin
+	}
+	if hash != "" {
+		a.PasswordHash = hash
+	}
+	if role != "" {
+		a.Role = role
+	}
+	return s.save()
+}
+
+// remove deletes a user.
+func (s *userStore) remove(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	a, ok := s.accounts[name]
+	if !ok {
+		return errUserNotFound
+	}
+	if a.Role == roleAdmin && s.admins() == 1 {
+		return errLastAdmin
+	}
+	delete(s.accounts, name)
+	return s.save()
+}
+
+// ensureAdmin creates the admin account with password, or resets its
+// password and role if it exists, so the -password flag always grants
+// admin access.
+func (s *userStore) ensureAdmin(password string) error {
+	if _, ok := s.lookup(adminUser); !ok {
+		return s.create(adminUser, password, roleAdmin)
+	}
+	return s.update(adminUser, password, roleAdmin)
+}
+
+func (s *userStore) admins() int {
+	n := 0
+	for _, a := range s.accounts {
+		if a.Role == roleAdmin {
+			n++
+		}
+	}
+	return n
+}
+
+func (s *userStore) save() error {
+	accounts := make([]*account, 0, len(s.accounts))
+	for _, a := range s.accounts {
+		accounts = append(accounts, a)
+	}
+	sort.Slice(accounts, func(i, j int) bool { return accounts[i].Name < accounts[j].Name })
+	data, err := json.MarshalIndent(accounts, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.path, func(w *bufio.Writer) error {
+		_, err := w.Write(data)
+		return err
+	})
+}
+
+// hashPassword hashes password for storage. The minimum length is enforced
+// by the API, not here, so -password can keep working with short ones.
+func hashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	return string(hash), err
+}
+
+// registerUserAPI adds the account management endpoints to mux. Admins
+// manage all accounts; other users may only change their own password.
+func registerUserAPI(mux *http.ServeMux, users *userStore) {
+	mux.HandleFunc("GET /api/users", adminOnly(func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, users.list())
+	}))
+
+	mux.HandleFunc("POST /api/users", adminOnly(func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Name     string `json:"name"`
+			Password string `json:"password"`
+			Role     string `json:"role"`
+		}
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&body); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if body.Role == "" {
+			body.Role = roleUser
+		}
+		if len(body.Password) < minPasswordLength {
+			writeUserError(w, errWeakPassword)
+			return
+		}
+		if err := users.create(body.Name, body.Password, body.Role); err != nil {
+			writeUserError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusCreated, identity{Name: body.Name, Role: body.Role})
+	}))
+
+	mux.HandleFunc("PATCH /api/users/{name}", func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Password string `json:"password"`
+			Role     string `json:"role"`
+		}
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&body); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		user, name := requestIdentity(r), r.PathValue("name")
+		if !user.isAdmin() && (user.Name != name || body.Role != "") {
+			http.Error(w, "Admin role required", http.StatusForbidden)
+			return
+		}
+		if body.Password != "" && len(body.Password) < minPasswordLength {
+			writeUserError(w, errWeakPassword)
+			return
+		}
+		if err := users.update(name, body.Password, body.Role); err != nil {
+			writeUserError(w, err)
+			return
+		}
+		updated, _ := users.lookup(name)
+		writeJSON(w, http.StatusOK, updated)
+	})
+
+	mux.HandleFunc("DELETE /api/users/{name}", adminOnly(func(w http.ResponseWriter, r *http.Request) {
+		if err := users.remove(r.PathValue("name")); err != nil {
+			writeUserError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+}
+
+func writeUserError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, errUserNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, errUserExists), errors.Is(err, errLastAdmin):
+		http.Error(w, err.Error(), http.StatusConflict)
+	case errors.Is(err, errInvalidUser), errors.Is(err, errInvalidRole), errors.Is(err, errWeakPassword):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	default:
+		log.Printf("error updating users: %v", err)
+		http.Error(w, "Failed to update users", http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,137 @@
+package server
+
+import (
+	"net"
+	"strconv"
+	"strings"
+	"subsonic/internal/scanner"
+)
+
+const (
+	maxQPS            = 100000
+	maxRecursionDepth = 5
+	maxWordlistKeys   = 16
+)
+
+// Error codes sent in scan_error messages.
+const (
+	errInvalidMessage      = "invalid_message"
+	errUnknownMessage      = "unknown_message_type"
+	errInvalidPayload      = "invalid_payload"
+	errInvalidDomain       = "invalid_domain"
+	errInvalidDNSServer    = "invalid_dns_server"
+	errInvalidConcurrency  = "invalid_concurrency"
+	errInvalidQPS          = "invalid_qps"
+	errInvalidRecursion    = "invalid_recursion"
+	errInvalidTemplate     = "invalid_template"
+	errInvalidShard        = "invalid_shard"
+	errInvalidWordlist     = "invalid_wordlist"
+	errWordlistUnavailable = "wordlist_unavailable"
+	errShuttingDown        = "shutting_down"
+	errScanNotFound        = "scan_not_found"
+	errHandshakeRequired   = "handshake_required"
+	errUnsupportedVersion  = "unsupported_version"
+)
+
+// ScanError is the payload of a scan_error message. Code is stable and meant
+// for programs. Key names the text explaining the error in the translation
+// catalogs, which can be more specific than Code, and Params are the values
+// filled into it; Message is that text in the client's language.
+type ScanError struct {
+	Code    string     `json:"code"`
+	Key     string     `json:"key"`
+	Params  textParams `json:"params,omitempty"`
+	Message string     `json:"message"`
+}
+
+func (e *ScanError) Error() string {
+	return e.Code + ": " + e.Message
+}
+
+func (e *ScanError) localize(c *catalog) interface{} {
+	localized := *e
+	localized.Message = c.text(e.Key, e.Params)
+	return &localized
+}
+
+// newScanError builds an error with the text key of the catalogs. Its
+// Message is rendered in the default language until it is sent.
+func newScanError(code, key string, params textParams) *ScanError {
+	return &ScanError{Code: code, Key: key, Params: params, Message: render(key, params)}
+}
+
+// validate checks the scan options and normalizes the domain and DNS servers
+// in place. WordlistKey is merged into WordlistKeys, without duplicates, and
+// the shard is parsed.
+func (p *StartScanPayload) validate() *ScanError {
+	domain := strings.ToLower(strings.TrimSuffix(strings.TrimSpace(p.Domain), "."))
+	if !validDomain(domain) {
+		return newScanError(errInvalidDomain, "error.invalid_domain", textParams{"domain": p.Domain})
+	}
+	p.Domain = domain
+
+	servers := make([]string, 0, len(p.DNSServers))
+	for _, s := range p.DNSServers {
+		server, ok := normalizeDNSServer(s)
+		if !ok {
+			return newScanError(errInvalidDNSServer, "error.invalid_dns_server", textParams{"server": s})
+		}
+		servers = append(servers, server)
+	}
+	p.DNSServers = servers
+
+	if p.Concurrency < 0 || p.Concurrency > scanner.MaxConcurrency {
+		return newScanError(errInvalidConcurrency, "error.invalid_concurrency", textParams{"max": scanner.MaxConcurrency})
+	}
+	if p.MaxQPS < 0 || p.MaxQPS > maxQPS {
+		return newScanError(errInvalidQPS, "error.invalid_qps", textParams{"max": maxQPS})
+	}
+	if p.RecursionDepth < 0 || p.RecursionDepth > maxRecursionDepth {
+		return newScanError(errInvalidRecursion, "error.invalid_recursion", textParams{"max": maxRecursionDepth})
+	}
+
+	keys := make([]string, 0, len(p.WordlistKeys)+1)
+	seen := make(map[string]struct{})
+	for _, key := range append([]string{p.WordlistKey}, p.WordlistKeys...) {
+		if _, ok := seen[key]; ok || key == "" {
+			continue
+		}
+		seen[key] = struct{}{}
+		keys = append(keys, key)
+	}
+	if len(keys) > maxWordlistKeys {
+		return newScanError(errInvalidWordlist, "error.too_many_wordlists", textParams{"max": maxWordlistKeys})
+	}
+	p.WordlistKeys = keys
+
+	shard, err := parseShard(p.Shard, p.ShardMode)
+	if err != nil {
+		return newScanError(errInvalidShard, "error.invalid_shard", textParams{"detail": err.Error()})
+	}
+	p.shard = shard
+	return nil
+}
+
+func validDomain(domain string) bool {
+	if domain == "" || !strings.Contains(domain, ".") || net.ParseIP(domain) != nil {
+		return false
+	}
+	return scanner.ValidName(domain)
+}
+
+// normalizeDNSServer accepts an IP address with an optional port and returns
+// it in host:port form, defaulting to port 53.
+func normalizeDNSServer(s string) (string, bool) {
+	s = strings.TrimSpace(s)
+	host, port, err := net.SplitHostPort(s)
+	if err != nil {
+		host, port = strings.Trim(s, "[]"), "53"
+	}
+	if net.ParseIP(host) == nil {
+		return "", false
+	}
+	if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+		return "", false
+	}
+	return net.JoinHostPort(host, port), true
+}
@@ -0,0 +1,269 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"subsonic/internal/scanner"
+)
+
+// maxInlineWords is the largest wordlist accepted inline in a start_scan
+// message. Larger lists have to go through /api/upload-wordlist.
+const maxInlineWords = 10000
+
+// maxInlineBytes bounds the size of an inline wordlist as sent, leaving the
+// rest of maxMessageSize to the other fields of the start_scan message.
+const maxInlineBytes = maxMessageSize - 1<<20
+
+// wordlistSource is where a scan's words come from: one or more registered
+// wordlists, or a list sent inline with the start_scan message.
+type wordlistSource struct {
+	lists []wordlistEntry
+	words []string
+	shard shardSpec
+
+	// shuffle randomizes the order words are streamed in, reproducibly for
+	// the same seed.
+	shuffle bool
+	seed    int64
+
+	// priority lists words to stream before all others, in this order. count
+	// drops those the source does not have, and the main pass leaves out the
+	// rest, so only the order words are queried in changes.
+	priority []string
+}
+
+// newWordlistSource prefers the inline wordlist when one is given and falls
+// back to the registered wordlists identified by keys.
+func newWordlistSource(wordlists *wordlistRegistry, keys []string, inline json.RawMessage, domain string) (wordlistSource, error) {
+	if len(inline) > 0 && string(inline) != "null" {
+		words, err := parseInlineWordlist(inline, domain)
+		if err != nil {
+			return wordlistSource{}, err
+		}
+		return wordlistSource{words: words}, nil
+	}
+	return registeredWordlistSource(wordlists, keys...)
+}
+
+// registeredWordlistSource looks keys up in the registry and pins the lists
+// until the source is released. Unknown keys are rejected rather than
+// resolved against the file system.
+func registeredWordlistSource(wordlists *wordlistRegistry, keys ...string) (wordlistSource, error) {
+	if len(keys) == 0 {
+		return wordlistSource{}, fmt.Errorf("no wordlist selected")
+	}
+	var source wordlistSource
+	for _, key := range keys {
+		entry, ok := wordlists.acquire(key)
+		if !ok {
+			source.release(wordlists)
+			return wordlistSource{}, fmt.Errorf("unknown wordlist %q", key)
+		}
+		source.lists = append(source.lists, *entry)
+	}
+	return source, nil
+}
+
+// release unpins the source's registered lists once the scan is done with
+// them.
+func (w wordlistSource) release(wordlists *wordlistRegistry) {
+	for _, list := range w.lists {
+		wordlists.release(list.ID)
+	}
+}
+
+func (w wordlistSource) String() string {
+	if len(w.lists) == 0 {
+		return fmt.Sprintf("inline (%d words)", len(w.words))
+	}
+	ids := make([]string, len(w.lists))
+	for i, list := range w.lists {
+		ids[i] = list.ID
+	}
+	return strings.Join(ids, "+")
+}
+
+// count returns the number of names the wordlist expands to under template,
+// without materializing them. A single registered list is not read at all
+// when the template uses {word} exactly once, the case its cached counts can
+// answer; combined lists have to be read to leave out duplicates, and shards
+// to count only their own words. A source with priority words is read too,
+// to keep only the priority words it has, as often as it has them.
+func (w *wordlistSource) count(template *scanner.Template) (int, error) {
+	if factor, wordRefs := template.Scale(); len(w.lists) == 1 && wordRefs == 1 && !w.shard.active() && len(w.priority) == 0 {
+		return factor * w.lists[0].Names, nil
+	}
+	var present map[string]int
+	if len(w.priority) > 0 {
+		present = make(map[string]int, len(w.priority))
+		for _, word := range w.priority {
+			present[word] = 0
+		}
+	}
+	count := 0
+	err := w.each(func(word string) {
+		count += template.Count(word)
+		if n, ok := present[word]; ok {
+			present[word] = n + 1
+		}
+	})
+	if err != nil {
+		return 0, err
+	}
+	if present != nil {
+		var priority []string
+		for _, word := range w.priority {
+			for i := 0; i < present[word]; i++ {
+				priority = append(priority, word)
+			}
+		}
+		w.priority = priority
+	}
+	return count, nil
+}
+
+// stream sends every word to wordlistChan and closes it. Priority words
+// come first; the rest are shuffled if requested. Once ctx is cancelled the
+// remaining words are read but dropped, as nobody receives them anymore.
+func (w wordlistSource) stream(ctx context.Context, wordlistChan chan<- string) {
+	defer close(wordlistChan)
+	send := func(word string) {
+		select {
+		case wordlistChan <- word:
+		case <-ctx.Done():
+		}
+	}
+
+	prioritized := make(map[string]struct{}, len(w.priority))
+	for _, word := range w.priority {
+		prioritized[word] = struct{}{}
+		send(word)
+	}
+	add := send
+	var shuffler *windowShuffler
+	if w.shuffle {
+		shuffler = newWindowShuffler(w.seed, send)
+		add = shuffler.add
+	}
+	err := w.each(func(word string) {
+		if _, ok := prioritized[word]; !ok {
+			add(word)
+		}
+	})
+	if shuffler != nil {
+		shuffler.flush()
+	}
+	if err != nil {
+		log.Printf("error reading wordlist %s: %v", w, err)
+	}
+}
+
+// each calls fn for every word of the source that belongs to its shard.
+func (w wordlistSource) each(fn func(string)) error {
+	if !w.shard.active() {
+		return w.eachWord(fn)
+	}
+
+	inShard := func(i int) bool { return i%w.shard.count == w.shard.index }
+	if w.shard.contiguous {
+		total, err := w.size()
+		if err != nil {
+			return err
+		}
+		lo, hi := w.shard.bounds(total)
+		inShard = func(i int) bool { return i >= lo && i < hi }
+	}
+	i := 0
+	return w.eachWord(func(word string) {
+		if inShard(i) {
+			fn(word)
+		}
+		i++
+	})
+}
+
+// size returns the number of words each visits before sharding. Only
+// combined lists have to be read for it.
+func (w wordlistSource) size() (int, error) {
+	switch len(w.lists) {
+	case 0:
+		return len(w.words), nil
+	case 1:
+		return w.lists[0].Lines, nil
+	}
+	n := 0
+	err := w.eachWord(func(string) { n++ })
+	return n, err
+}
+
+// eachWord calls fn for every word of the source. When several lists are
+// combined, words an earlier list already had are skipped, which keeps one
+// set of all distinct words in memory for the duration of the pass.
+func (w wordlistSource) eachWord(fn func(string)) error {
+	if len(w.lists) == 0 {
+		for _, word := range w.words {
+			fn(word)
+		}
+		return nil
+	}
+
+	var seen map[string]struct{}
+	if len(w.lists) > 1 {
+		seen = make(map[string]struct{})
+	}
+	for _, list := range w.lists {
+		file, err := list.open()
+		if err != nil {
+			return err
+		}
+		err = readLines(file, func(word string) error {
+			if seen != nil {
+				if _, ok := seen[word]; ok {
+					return nil
+				}
+				seen[word] = struct{}{}
+			}
+			fn(word)
+			return nil
+		})
+		file.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseInlineWordlist accepts either a JSON array of words or a single string
+// of newline-separated words, normalized the same way as uploads.
+func parseInlineWordlist(raw json.RawMessage, domain string) ([]string, error) {
+	if len(raw) > maxInlineBytes {
+		return nil, fmt.Errorf("inline wordlist is %d bytes, the limit is %d; upload larger lists instead", len(raw), maxInlineBytes)
+	}
+	var lines []string
+	if err := json.Unmarshal(raw, &lines); err != nil {
+		var text string
+		if err := json.Unmarshal(raw, &text); err != nil {
+			return nil, fmt.Errorf("wordlist must be an array of strings or newline-separated text")
+		}
+		lines = strings.Split(text, "\n")
+	}
+
+	n := newWordNormalizer(domain)
+	words := make([]string, 0, len(lines))
+	for _, line := range lines {
+		if word, ok := n.normalize(line); ok {
+			words = append(words, word)
+		}
+	}
+	if len(words) == 0 {
+		return nil, fmt.Errorf("inline wordlist is empty")
+	}
+	if len(words) > maxInlineWords {
+		return nil, fmt.Errorf("inline wordlist has %d words, the limit is %d; upload larger lists instead", len(words), maxInlineWords)
+	}
+	return words, nil
+}
@@ -0,0 +1,205 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	// maxDecompressionRatio bounds the decompressed size of a compressed
+	// upload relative to the maximum upload size.
+	maxDecompressionRatio = 16
+
+	defaultPreviewLines = 20
+	maxPreviewLines     = 1000
+	maxLabelLength      = 128
+)
+
+// registerWordlistAPI adds the wordlist upload and management endpoints to
+// mux. Uploads larger than maxUploadSize bytes are rejected. Every user may
+// upload; renaming and deleting is up to admins.
+func registerWordlistAPI(mux *http.ServeMux, wordlists *wordlistRegistry, maxUploadSize int64) {
+	mux.HandleFunc("/api/upload-wordlist", func(w http.ResponseWriter, r *http.Request) {
+		handleUploadWordlist(wordlists, maxUploadSize, w, r)
+	})
+
+	mux.HandleFunc("GET /api/wordlists", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, wordlists.list())
+	})
+
+	mux.HandleFunc("GET /api/wordlists/builtin", func(w http.ResponseWriter, r *http.Request) {
+		builtin := []wordlistEntry{}
+		for _, entry := range wordlists.list() {
+			if entry.Builtin {
+				builtin = append(builtin, entry)
+			}
+		}
+		writeJSON(w, http.StatusOK, builtin)
+	})
+
+	mux.HandleFunc("GET /api/wordlists/{id}/preview", func(w http.ResponseWriter, r *http.Request) {
+		n := defaultPreviewLines
+		if v := r.URL.Query().Get("lines"); v != "" {
+			parsed, err := strconv.Atoi(v)
+			if err != nil || parsed < 1 {
+				http.Error(w, "Invalid line count", http.StatusBadRequest)
+				return
+			}
+			n = min(parsed, maxPreviewLines)
+		}
+		lines, err := wordlists.preview(r.PathValue("id"), n)
+		if err != nil {
+			writeWordlistError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"lines": lines})
+	})
+
+	mux.HandleFunc("PATCH /api/wordlists/{id}", adminOnly(func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Label string `json:"label"`
+		}
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&body); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		label := strings.TrimSpace(body.Label)
+		if label == "" || len(label) > maxLabelLength {
+			http.Error(w, "Label must be between 1 and 128 bytes", http.StatusBadRequest)
+			return
+		}
+		entry, err := wordlists.rename(r.PathValue("id"), label)
+		if err != nil {
+			writeWordlistError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, entry)
+	}))
+
+	mux.HandleFunc("DELETE /api/wordlists/{id}", adminOnly(func(w http.ResponseWriter, r *http.Request) {
+		if err := wordlists.remove(r.PathValue("id")); err != nil {
+			writeWordlistError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+}
+
+// handleUploadWordlist streams the "wordlist" part of a multipart upload,
+// plain or gzip/zstd compressed, through the normalizer into the registry, without buffering the whole body
+// first. An optional "domain" query parameter is stripped from entries that
+// are full hostnames.
+func handleUploadWordlist(wordlists *wordlistRegistry, maxUploadSize int64, w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Leave some room for the multipart headers around the file itself.
+	r.Body = http.MaxBytesReader(w, r.Body, maxUploadSize+64<<10)
+	reader, err := r.MultipartReader()
+	if err != nil {
+		http.Error(w, "Invalid file upload", http.StatusBadRequest)
+		return
+	}
+
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			http.Error(w, "Invalid file upload", http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			writeUploadError(w, err)
+			return
+		}
+		if part.FormName() != "wordlist" {
+			part.Close()
+			continue
+		}
+
+		// The upload is normalized on its way to disk, so the stored list and
+		// its content hash only ever reflect the cleaned entries.
+		// Compressed uploads are unpacked here, with the decompressed size
+		// capped so a small archive cannot expand without bound.
+		raw := &io.LimitedReader{R: part, N: maxUploadSize + 1}
+		content, err := decompressReader(raw)
+		if err != nil {
+			part.Close()
+			http.Error(w, "Invalid compressed wordlist", http.StatusBadRequest)
+			return
+		}
+		plain := &io.LimitedReader{R: content, N: maxUploadSize*maxDecompressionRatio + 1}
+		pr, pw := io.Pipe()
+		statsChan := make(chan normalizeStats, 1)
+		go func() {
+			stats, err := normalizeWordlist(pw, plain, r.URL.Query().Get("domain"))
+			statsChan <- stats
+			pw.CloseWithError(err)
+		}()
+
+		entry, duplicate, err := wordlists.storeUpload(pr, part.FileName())
+		pr.Close()
+		stats := <-statsChan
+		content.Close()
+		part.Close()
+		if err != nil {
+			writeUploadError(w, err)
+			return
+		}
+		if raw.N == 0 || plain.N == 0 {
+			if !duplicate {
+				wordlists.remove(entry.ID)
+			}
+			writeUploadError(w, &http.MaxBytesError{Limit: maxUploadSize})
+			return
+		}
+
+		response := map[string]interface{}{
+			"wordlist_key": entry.ID,
+			"duplicate":    duplicate,
+			"wordlist":     entry,
+			"normalized":   stats,
+		}
+		writeJSON(w, http.StatusOK, response)
+		return
+	}
+}
+
+func writeUploadError(w http.ResponseWriter, err error) {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		http.Error(w, "Wordlist exceeds the maximum upload size", http.StatusRequestEntityTooLarge)
+		return
+	}
+	if errors.Is(err, errTooManyEntries) {
+		http.Error(w, "Wordlist has more than the maximum number of distinct entries", http.StatusRequestEntityTooLarge)
+		return
+	}
+	log.Printf("error saving uploaded wordlist: %v", err)
+	http.Error(w, "Failed to save file", http.StatusInternalServerError)
+}
+
+func writeWordlistError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, errWordlistNotFound):
+		http.Error(w, "Wordlist not found", http.StatusNotFound)
+	case errors.Is(err, errWordlistBuiltin):
+		http.Error(w, "Built-in wordlists cannot be modified", http.StatusForbidden)
+	case errors.Is(err, errWordlistInUse):
+		http.Error(w, "Wordlist is in use by a running scan", http.StatusConflict)
+	default:
+		http.Error(w, "Failed to access wordlist", http.StatusInternalServerError)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
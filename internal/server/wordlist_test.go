@@ -0,0 +1,63 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseInlineWordlist(t *testing.T) {
+	tests := []struct {
+		raw     string
+		want    []string
+		wantErr bool
+	}{
+		{`["www", "API", "api", "mail.example.com."]`, []string{"www", "api", "mail"}, false},
+		{`"www\napi\r\n\n# comment\nbücher"`, []string{"www", "api", "xn--bcher-kva"}, false},
+		{`["web{0-9}", "-bad", "example.com"]`, []string{"web{0-9}"}, false},
+		{`[]`, nil, true},
+		{`""`, nil, true},
+		{`["-bad", "a..b"]`, nil, true},
+		{`{"words": ["www"]}`, nil, true},
+		{`[1, 2]`, nil, true},
+		{`null`, nil, true},
+	}
+	for _, tt := range tests {
+		got, err := parseInlineWordlist(json.RawMessage(tt.raw), "example.com")
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseInlineWordlist(%s) error = %v, wantErr %v", tt.raw, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseInlineWordlist(%s) = %q, want %q", tt.raw, got, tt.want)
+		}
+	}
+}
+
+func TestParseInlineWordlistLimits(t *testing.T) {
+	// The longest list accepted by word count must also fit the byte limit,
+	// and so a single websocket message.
+	words := make([]string, maxInlineWords)
+	for i := range words {
+		words[i] = fmt.Sprintf("%06d", i) + strings.Repeat(".abcdefghijklmnopqrstuvwxyz", 9)
+	}
+	raw, err := json.Marshal(words)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := parseInlineWordlist(raw, ""); err != nil || len(got) != maxInlineWords {
+		t.Errorf("parseInlineWordlist of %d long words = %d words, %v, want all of them", maxInlineWords, len(got), err)
+	}
+
+	raw, _ = json.Marshal(append(words, "one-more"))
+	if _, err := parseInlineWordlist(raw, ""); err == nil {
+		t.Errorf("parseInlineWordlist accepted %d words", maxInlineWords+1)
+	}
+
+	raw, _ = json.Marshal(strings.Repeat("www\n", maxInlineBytes/4+1))
+	if _, err := parseInlineWordlist(raw, ""); err == nil {
+		t.Errorf("parseInlineWordlist accepted %d bytes", len(raw))
+	}
+}
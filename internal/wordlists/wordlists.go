@@ -0,0 +1,65 @@
+// Package wordlists holds the built-in wordlists compiled into the binary, so
+// the server can scan without any files next to it.
+package wordlists
+
+import (
+	"embed"
+	"io/fs"
+)
+
+//go:embed lists/*.txt lists/*.txt.gz
+var files embed.FS
+
+// List describes one built-in wordlist. Its name and description are
+// translated by the server's catalogs under "wordlist.<ID>" and
+// "wordlist.<ID>.description".
+type List struct {
+	ID       string
+	Category string
+	File     string
+}
+
+// Catalog is every built-in list, general-purpose lists from small to large
+// followed by specialized ones. IDs are stable; clients select lists by them.
+// Large lists are embedded gzip-compressed.
+var Catalog = []List{
+	{
+		ID:       "top100",
+		Category: "general",
+		File:     "top100.txt",
+	},
+	{
+		ID:       "top1000",
+		Category: "general",
+		File:     "top1000.txt",
+	},
+	{
+		ID:       "common_speak",
+		Category: "general",
+		File:     "common_speak.txt",
+	},
+	{
+		ID:       "top110000",
+		Category: "general",
+		File:     "top110000.txt.gz",
+	},
+	{
+		ID:       "cloud",
+		Category: "specialized",
+		File:     "cloud.txt",
+	},
+	{
+		ID:       "api",
+		Category: "specialized",
+		File:     "api.txt",
+	},
+}
+
+// FS returns the file system the lists' File names refer to.
+func FS() fs.FS {
+	sub, err := fs.Sub(files, "lists")
+	if err != nil {
+		panic(err)
+	}
+	return sub
+}
@@ -5,6 +5,8 @@ import (
 	"flag"
 	"io/fs"
 	"log"
+	"os"
+	"strings"
 	"subsonic/internal/server"
 )
 
@@ -13,7 +15,17 @@ var embeddedFiles embed.FS
 
 func main() {
 	debugNetwork := flag.Bool("debug-network", false, "Enable detailed network error logging for DNS resolution.")
+	bind := flag.String("bind", "", "Address to listen on, e.g. 127.0.0.1 for local access only; empty listens on all interfaces")
 	port := flag.String("port", "8080", "Port to run the server on")
+	tlsCert := flag.String("tls-cert", "", "Certificate file to serve HTTPS with, requires -tls-key")
+	tlsKey := flag.String("tls-key", "", "Private key file for -tls-cert")
+	tlsSelfSigned := flag.Bool("tls-self-signed", false, "Serve HTTPS with a self-signed certificate generated into tls/ on first run")
+	maxUploadMB := flag.Int64("max-upload-mb", 256, "Maximum size of an uploaded wordlist in MiB")
+	uploadTTL := flag.Duration("upload-ttl", 0, "Delete uploaded wordlists unused for this long (e.g. 720h); 0 keeps them forever")
+	maxUploadsMB := flag.Int64("max-uploads-mb", 0, "Maximum total size of uploaded wordlists in MiB, least recently used are deleted first; 0 means no limit")
+	password := flag.String("password", os.Getenv("SUBSONIC_PASSWORD"), "Password for the web UI (default $SUBSONIC_PASSWORD); empty disables authentication unless -auth-token is set")
+	authTokens := flag.String("auth-token", os.Getenv("SUBSONIC_AUTH_TOKEN"), "Comma-separated bearer tokens for API clients, also accepted as UI password (default $SUBSONIC_AUTH_TOKEN)")
+	allowedOrigins := flag.String("allowed-origins", "", "Comma-separated extra origins allowed to use the API and websocket, e.g. http://localhost:5173")
 	flag.Parse()
 
 	// We must create a sub-filesystem that starts from the 'frontend/dist' directory.
@@ -21,5 +33,29 @@ func main() {
 	if err != nil {
 		log.Fatalf("Failed to create sub-filesystem: %v", err)
 	}
-	server.Serve(distFS, *debugNetwork, *port)
+	server.Serve(distFS, server.Config{
+		Host:           *bind,
+		Port:           *port,
+		TLSCert:        *tlsCert,
+		TLSKey:         *tlsKey,
+		TLSSelfSigned:  *tlsSelfSigned,
+		DebugNetwork:   *debugNetwork,
+		MaxUploadSize:  *maxUploadMB << 20,
+		UploadTTL:      *uploadTTL,
+		MaxUploadsSize: *maxUploadsMB << 20,
+		Password:       *password,
+		AuthTokens:     splitList(*authTokens),
+		AllowedOrigins: splitList(*allowedOrigins),
+	})
+}
+
+// splitList splits a comma-separated flag value, dropping empty items.
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
 }